@@ -9,6 +9,7 @@ import (
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() token.Position // Where the node starts in the source
 }
 
 // A singular instruction
@@ -35,6 +36,13 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Instructions) > 0 {
+		return p.Instructions[0].Pos()
+	}
+	return token.Position{Line: 1, Column: 1}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -54,6 +62,7 @@ type AssemblerInstruction struct {
 
 func (ai *AssemblerInstruction) instructionNode() {}
 func (ai *AssemblerInstruction) TokenLiteral() string { return ai.Opcode.Literal }
+func (ai *AssemblerInstruction) Pos() token.Position  { return ai.Opcode.Pos() }
 func (ai *AssemblerInstruction) String() string {
 	var out bytes.Buffer
 
@@ -81,13 +90,134 @@ type RegisterLiteral struct {
 
 func (rl *RegisterLiteral) expressionNode()      {}
 func (rl *RegisterLiteral) TokenLiteral() string { return rl.Token.Literal }
+func (rl *RegisterLiteral) Pos() token.Position  { return rl.Token.Pos() }
 func (rl *RegisterLiteral) String() string       { return "$" + rl.Token.Literal }
 
 type IntegerLiteral struct {
 	Token token.Token
-	Value uint16
+	Value int64 // Checked against the field it is encoded into by the parser
 }
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
-func (il *IntegerLiteral) String() string       { return "#" + il.Token.Literal }
\ No newline at end of file
+func (il *IntegerLiteral) Pos() token.Position  { return il.Token.Pos() }
+func (il *IntegerLiteral) String() string       { return "#" + il.Token.Literal }
+
+type LabelDeclaration struct {
+	Token token.Token // The token.LABEL token
+	Name  string
+}
+
+func (ld *LabelDeclaration) instructionNode()     {}
+func (ld *LabelDeclaration) TokenLiteral() string { return ld.Token.Literal }
+func (ld *LabelDeclaration) Pos() token.Position  { return ld.Token.Pos() }
+func (ld *LabelDeclaration) String() string       { return ld.Name + ":" }
+
+type LabelReference struct {
+	Token token.Token // The token.LABEL_REF token
+	Name  string
+}
+
+func (lr *LabelReference) expressionNode()      {}
+func (lr *LabelReference) TokenLiteral() string { return lr.Token.Literal }
+func (lr *LabelReference) Pos() token.Position  { return lr.Token.Pos() }
+func (lr *LabelReference) String() string       { return "@" + lr.Name }
+
+type SectionDirective struct {
+	Token token.Token // The token.CODE or token.DATA token
+}
+
+func (sd *SectionDirective) instructionNode()     {}
+func (sd *SectionDirective) TokenLiteral() string { return sd.Token.Literal }
+func (sd *SectionDirective) Pos() token.Position  { return sd.Token.Pos() }
+func (sd *SectionDirective) String() string       { return "." + sd.Token.Literal }
+
+type DataDirective struct {
+	Token  token.Token // The directive token, ie `token.BYTE`
+	Values []Expression
+}
+
+func (dd *DataDirective) instructionNode()     {}
+func (dd *DataDirective) TokenLiteral() string { return dd.Token.Literal }
+func (dd *DataDirective) Pos() token.Position  { return dd.Token.Pos() }
+func (dd *DataDirective) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("." + dd.Token.Literal)
+
+	for i, v := range dd.Values {
+		if i == 0 {
+			out.WriteString(" ")
+		} else {
+			out.WriteString(", ")
+		}
+		out.WriteString(v.String())
+	}
+
+	out.WriteString(";")
+
+	return out.String()
+}
+
+type StringLiteral struct {
+	Token token.Token
+	Value string // The string with its escape sequences decoded
+}
+
+func (sl *StringLiteral) expressionNode()      {}
+func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() token.Position  { return sl.Token.Pos() }
+func (sl *StringLiteral) String() string       { return `"` + sl.Token.Literal + `"` }
+
+type EntryDirective struct {
+	Token token.Token // The token.ENTRY token
+	Label *LabelReference
+}
+
+func (ed *EntryDirective) instructionNode()     {}
+func (ed *EntryDirective) TokenLiteral() string { return ed.Token.Literal }
+func (ed *EntryDirective) Pos() token.Position  { return ed.Token.Pos() }
+func (ed *EntryDirective) String() string       { return ".entry " + ed.Label.String() + ";" }
+
+// A unary operator in a constant expression, ie `-4`
+type PrefixExpression struct {
+	Token    token.Token // The operator token
+	Operator string
+	Right    Expression
+}
+
+func (pe *PrefixExpression) expressionNode()      {}
+func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Position  { return pe.Token.Pos() }
+func (pe *PrefixExpression) String() string {
+	return "(" + pe.Operator + pe.Right.String() + ")"
+}
+
+// A binary operator in a constant expression, ie `@end - @start`
+type InfixExpression struct {
+	Token    token.Token // The operator token
+	Left     Expression
+	Operator string
+	Right    Expression
+}
+
+func (ie *InfixExpression) expressionNode()      {}
+func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() token.Position  { return ie.Left.Pos() }
+func (ie *InfixExpression) String() string {
+	return "(" + ie.Left.String() + " " + ie.Operator + " " + ie.Right.String() + ")"
+}
+
+// HIGH(x) or LOW(x), the upper or lower 16 bits of a value
+type CallExpression struct {
+	Token    token.Token // The token.FUNCTION token
+	Function string      // The function name in upper case
+	Argument Expression
+}
+
+func (ce *CallExpression) expressionNode()      {}
+func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position  { return ce.Token.Pos() }
+func (ce *CallExpression) String() string {
+	return ce.Function + "(" + ce.Argument.String() + ")"
+}
@@ -0,0 +1,349 @@
+// Package cfg splits a program into basic blocks and works out how control
+// flows between them, following the constants loaded into jump registers.
+package cfg
+
+import (
+	"fmt"
+	"simpsel/code"
+	"simpsel/compiler"
+	"sort"
+)
+
+type EdgeKind int
+
+const (
+	Fallthrough EdgeKind = iota // Runs on into the next block
+	Jump                        // jmp, jmpf or jmpb
+	Branch                      // A jump on a flag, like jmpe or jz, when it's taken
+	Call                        // call, the block after it is reached by a Fallthrough once it returns
+)
+
+var edgeKindNames = map[EdgeKind]string{
+	Fallthrough: "fallthrough",
+	Jump:        "jump",
+	Branch:      "branch",
+	Call:        "call",
+}
+
+func (k EdgeKind) String() string {
+	if name, ok := edgeKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("EdgeKind(%d)", int(k))
+}
+
+type Edge struct {
+	From, To *Block
+	Kind     EdgeKind
+}
+
+// A run of instructions that's only ever entered at the top and left at the bottom
+type Block struct {
+	ID         int
+	Start, End int // Code offsets, End is exclusive
+	Succs      []*Edge
+	Preds      []*Edge
+	Reachable  bool // Whether control can get here from the entry point
+	Unresolved bool // Whether it ends in a jump whose target couldn't be worked out
+}
+
+type Graph struct {
+	Instructions code.Instructions
+	Blocks       []*Block // In offset order
+	Entry        *Block
+	Labels       map[int]string // Code labels by offset, from the symbol table
+}
+
+// A decoded instruction
+type instruction struct {
+	offset   int
+	op       code.Opcode
+	operands []int
+}
+
+// The registers known to hold a constant. nil means no path has reached it yet.
+type state map[int]int32
+
+// Builds the control flow graph of a program
+func Build(bytecode *compiler.Bytecode) (*Graph, error) {
+	g := &Graph{Instructions: bytecode.Instructions, Labels: map[int]string{}}
+
+	program, err := decode(bytecode.Instructions)
+	if err != nil {
+		return nil, err
+	}
+	if len(program) == 0 {
+		return g, nil
+	}
+
+	leaders := map[int]bool{0: true, bytecode.Entry: true}
+	for _, sym := range bytecode.Symbols {
+		if sym.Section == compiler.CodeSection && sym.Offset < len(bytecode.Instructions) {
+			leaders[sym.Offset] = true
+			g.Labels[sym.Offset] = sym.Name
+		}
+	}
+	for i, ins := range program {
+		if endsBlock(ins.op) && i+1 < len(program) {
+			leaders[program[i+1].offset] = true
+		}
+	}
+
+	// A jump into the middle of a block splits it, which can change what's
+	// known about the registers, so keep going until no new leaders turn up
+	for {
+		g.split(program, leaders)
+		g.Entry = g.blockAt(bytecode.Entry)
+		if g.resolve(program, leaders) {
+			return g, nil
+		}
+	}
+}
+
+func decode(ins code.Instructions) ([]instruction, error) {
+	if len(ins)%code.InstructionWidth != 0 {
+		return nil, fmt.Errorf("program is %d bytes, not a multiple of %d", len(ins), code.InstructionWidth)
+	}
+
+	var program []instruction
+	for offset := 0; offset < len(ins); offset += code.InstructionWidth {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %s", offset, err)
+		}
+		program = append(program, instruction{
+			offset:   offset,
+			op:       code.Opcode(ins[offset]),
+			operands: code.ReadOperands(def, ins[offset+1:]),
+		})
+	}
+	return program, nil
+}
+
+// Whether op is the last instruction of its block
+func endsBlock(op code.Opcode) bool {
+	return code.IsTerminator(op) || code.IsBranch(op) || op == code.OpCall || op == code.OpCalli
+}
+
+func (g *Graph) split(program []instruction, leaders map[int]bool) {
+	g.Blocks = nil
+	for _, ins := range program {
+		if leaders[ins.offset] {
+			g.Blocks = append(g.Blocks, &Block{ID: len(g.Blocks), Start: ins.offset})
+		}
+		g.Blocks[len(g.Blocks)-1].End = ins.offset + code.InstructionWidth
+	}
+}
+
+// The block holding the instruction at offset, nil if there isn't one
+func (g *Graph) blockAt(offset int) *Block {
+	i := sort.Search(len(g.Blocks), func(i int) bool { return g.Blocks[i].End > offset })
+	if i == len(g.Blocks) || g.Blocks[i].Start > offset {
+		return nil
+	}
+	return g.Blocks[i]
+}
+
+// Propagates constants from the entry point until nothing changes, then adds
+// the edges. Returns false, having added the new leaders, if a jump lands in
+// the middle of a block.
+func (g *Graph) resolve(program []instruction, leaders map[int]bool) bool {
+	in := make([]state, len(g.Blocks))
+	if g.Entry == nil {
+		return true
+	}
+	in[g.Entry.ID] = state{}
+
+	split := false
+	work := []*Block{g.Entry}
+	for len(work) > 0 {
+		b := work[0]
+		work = work[1:]
+
+		last, out := g.run(program, b, in[b.ID])
+		targets, _ := g.targets(last, out)
+		for _, target := range targets {
+			if !leaders[target.offset] {
+				leaders[target.offset] = true
+				split = true
+				continue
+			}
+			succ := g.blockAt(target.offset)
+			if merged, changed := meet(in[succ.ID], target.state); changed {
+				in[succ.ID] = merged
+				work = append(work, succ)
+			}
+		}
+	}
+	if split {
+		return false
+	}
+
+	for _, b := range g.Blocks {
+		b.Reachable = in[b.ID] != nil
+		if !b.Reachable {
+			// Nothing's known about the registers, but the edges are still worth showing
+			in[b.ID] = state{}
+		}
+	}
+	for _, b := range g.Blocks {
+		last, out := g.run(program, b, in[b.ID])
+		targets, resolved := g.targets(last, out)
+		b.Unresolved = !resolved
+		for _, target := range targets {
+			if succ := g.blockAt(target.offset); succ != nil && succ.Start == target.offset {
+				edge := &Edge{From: b, To: succ, Kind: target.kind}
+				b.Succs = append(b.Succs, edge)
+				succ.Preds = append(succ.Preds, edge)
+			}
+		}
+	}
+	return true
+}
+
+// Runs the instructions of b over the registers known on entry, returning
+// its last instruction and what's known just before it runs
+func (g *Graph) run(program []instruction, b *Block, in state) (instruction, state) {
+	known := state{}
+	for reg, value := range in {
+		known[reg] = value
+	}
+
+	first := b.Start / code.InstructionWidth
+	last := b.End/code.InstructionWidth - 1
+	for _, ins := range program[first:last] {
+		step(known, ins)
+	}
+	return program[last], known
+}
+
+// Updates known with the effect of ins on the registers
+func step(known state, ins instruction) {
+	reads, writes := code.RegisterEffects(ins.op, ins.operands)
+	switch ins.op {
+	case code.OpLoad:
+		known[ins.operands[0]] = int32(ins.operands[1])
+		return
+	case code.OpLui:
+		if value, ok := known[ins.operands[0]]; ok {
+			known[ins.operands[0]] = int32(uint32(ins.operands[1])<<16 | uint32(value)&0xFFFF)
+			return
+		}
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		a, aok := known[reads[0]]
+		b, bok := known[reads[1]]
+		if aok && bok && (ins.op != code.OpDiv || b != 0) {
+			known[writes[0]] = fold(ins.op, a, b)
+			return
+		}
+	case code.OpAddi, code.OpSubi, code.OpMuli:
+		if a, ok := known[reads[0]]; ok {
+			known[writes[0]] = fold(ins.op, a, int32(ins.operands[1]))
+			return
+		}
+	case code.OpCall, code.OpCalli:
+		// The callee can change any register
+		for reg := range known {
+			delete(known, reg)
+		}
+		return
+	}
+
+	for _, reg := range writes {
+		delete(known, reg)
+	}
+}
+
+func fold(op code.Opcode, a, b int32) int32 {
+	switch op {
+	case code.OpAdd, code.OpAddi:
+		return a + b
+	case code.OpSub, code.OpSubi:
+		return a - b
+	case code.OpMul, code.OpMuli:
+		return a * b
+	}
+	return a / b
+}
+
+// Where control can go after a block
+type target struct {
+	offset int
+	kind   EdgeKind
+	state  state // What's known about the registers when it gets there
+}
+
+// Works out where control goes after last, given what's known just before
+// it. resolved is false if it's a jump to a register that isn't known.
+func (g *Graph) targets(last instruction, known state) (targets []target, resolved bool) {
+	after := state{}
+	for reg, value := range known {
+		after[reg] = value
+	}
+	step(after, last)
+	next := last.offset + code.InstructionWidth
+
+	add := func(offset int, kind EdgeKind, s state) {
+		if offset >= 0 && offset < len(g.Instructions) && offset%code.InstructionWidth == 0 {
+			targets = append(targets, target{offset: offset, kind: kind, state: s})
+		}
+	}
+	// relative is 0 for an absolute jump, 1 for jmpf and -1 for jmpb
+	jump := func(kind EdgeKind, relative int, s state) bool {
+		value, ok := known[last.operands[0]]
+		if !ok {
+			return false
+		}
+		if relative == 0 {
+			add(int(value), kind, s)
+		} else {
+			add(next+relative*int(value), kind, s)
+		}
+		return true
+	}
+
+	resolved = true
+	switch last.op {
+	case code.OpHlt, code.OpIgl, code.OpRet:
+	case code.OpJmp:
+		resolved = jump(Jump, 0, after)
+	case code.OpJmpf:
+		resolved = jump(Jump, 1, after)
+	case code.OpJmpb:
+		resolved = jump(Jump, -1, after)
+	case code.OpCall:
+		// The callee starts with the caller's registers, the code after the call doesn't
+		resolved = jump(Call, 0, known)
+		add(next, Fallthrough, after)
+	case code.OpCalli:
+		add(last.operands[0], Call, known)
+		add(next, Fallthrough, after)
+	default:
+		if code.IsBranch(last.op) {
+			resolved = jump(Branch, 0, after)
+		}
+		add(next, Fallthrough, after)
+	}
+	return targets, resolved
+}
+
+// Combines what's known at a block from another path. Only registers that
+// hold the same constant on both paths stay known.
+func meet(old, incoming state) (state, bool) {
+	if old == nil {
+		merged := state{}
+		for reg, value := range incoming {
+			merged[reg] = value
+		}
+		return merged, true
+	}
+
+	changed := false
+	for reg, value := range old {
+		if other, ok := incoming[reg]; !ok || other != value {
+			delete(old, reg)
+			changed = true
+		}
+	}
+	return old, changed
+}
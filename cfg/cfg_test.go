@@ -0,0 +1,130 @@
+package cfg
+
+import (
+	"fmt"
+	"simpsel/compiler/compilertest"
+	"strings"
+	"testing"
+)
+
+func build(t *testing.T, input string) *Graph {
+	t.Helper()
+
+	g, err := Build(compilertest.Compile(t, input).Bytecode())
+	if err != nil {
+		t.Fatalf("cfg error: %s", err)
+	}
+	return g
+}
+
+// Describes each block as `start-end: edges`, ie `0-12: ->12`, with a ? for unresolved
+// jumps and a ! for unreachable blocks
+func describe(g *Graph) []string {
+	blocks := []string{}
+	for _, b := range g.Blocks {
+		desc := fmt.Sprintf("%d-%d:", b.Start, b.End)
+		for _, e := range b.Succs {
+			if e.Kind == Fallthrough {
+				desc += fmt.Sprintf(" ->%d", e.To.Start)
+			} else {
+				desc += fmt.Sprintf(" %s->%d", e.Kind, e.To.Start)
+			}
+		}
+		if b.Unresolved {
+			desc += " ?"
+		}
+		if !b.Reachable {
+			desc += " !"
+		}
+		blocks = append(blocks, desc)
+	}
+	return blocks
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{
+			// The double counter from test.sasm, with $31 reloaded for the second loop
+			`.macro count_to limit, step, counter
+load $31 @loop
+loop:
+add counter step counter
+neq counter limit
+jmpe $31
+.endm
+count_to #65535, #1, $2
+load $2 #0
+count_to #65535, #1, $2
+hlt`,
+			[]string{"0-4: ->4", "4-16: branch->4 ->16", "16-24: ->24", "24-36: branch->24 ->36", "36-40:"},
+		},
+		{
+			// jmpf lands in the middle of a block, splitting it
+			"load $1 #4\njmpf $1\nnop\nnop\nhlt",
+			[]string{"0-8: jump->12", "8-12: ->12 !", "12-20:"},
+		},
+		{
+			"load $1 #8\nback:\nnop\nload $2 #12\njmpb $2\nhlt",
+			[]string{"0-4: ->4", "4-16: jump->4", "16-20: !"},
+		},
+		{
+			"load $1 @end\nload $2 #1\neq $2 $2\njmpne $1\nnop\nend:\nhlt",
+			[]string{"0-16: branch->20 ->16", "16-20: ->20", "20-24:"},
+		},
+		{
+			"load $1 @end\nload $2 #1\nadd $2 $2 $3\njo $1\nnop\nend:\nhlt",
+			[]string{"0-16: branch->20 ->16", "16-20: ->20", "20-24:"},
+		},
+		{
+			// The jump register is worked out with an immediate
+			"load $1 @end\naddi $1 #4\njmp $1\nend:\nhlt\nhlt",
+			[]string{"0-12: jump->16", "12-16: !", "16-20:"},
+		},
+		{
+			"pop $1\njmp $1\nhlt",
+			[]string{"0-8: ?", "8-12: !"},
+		},
+		{
+			"call @f\nhlt\nf:\nret",
+			[]string{"0-4: call->8 ->4", "4-8:", "8-12:"},
+		},
+		{
+			// Only a constant that's the same on every path gets followed
+			"load $3 #1\nload $1 #20\neq $3 $3\njmpe $1\nload $1 #24\nnext:\njmp $1\nhlt",
+			[]string{"0-16: branch->20 ->16", "16-20: ->20", "20-24: ?", "24-28: !"},
+		},
+	}
+
+	for _, tt := range tests {
+		actual := describe(build(t, tt.input))
+		if strings.Join(actual, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("wrong graph for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	g := build(t, "load $1 @loop\nloop:\neq $0 $0\njmpe $1\nhlt")
+
+	var out strings.Builder
+	if err := g.WriteDOT(&out); err != nil {
+		t.Fatalf("dot error: %s", err)
+	}
+
+	expected := `digraph cfg {
+	node [shape=box fontname="monospace"];
+	b0 [label="L0000:\l0000  load $1 #4\l" penwidth=2];
+	b1 [label="loop:\l0004  eq $0 $0\l0008  jmpe $1\l"];
+	b2 [label="L0012:\l0012  hlt\l"];
+	b0 -> b1;
+	b1 -> b1 [label="branch"];
+	b1 -> b2;
+}
+`
+	if out.String() != expected {
+		t.Errorf("wrong DOT.\nwant=%q\ngot =%q", expected, out.String())
+	}
+}
@@ -0,0 +1,65 @@
+package cfg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"simpsel/code"
+	"strings"
+)
+
+// Writes the graph in Graphviz's DOT language, one box per block holding its
+// instructions. Unreachable blocks are dashed, and blocks ending in a jump
+// that couldn't be resolved are red.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	fmt.Fprintf(out, "digraph cfg {\n")
+	fmt.Fprintf(out, "\tnode [shape=box fontname=\"monospace\"];\n")
+	for _, b := range g.Blocks {
+		var label strings.Builder
+		name := code.LabelName(b.Start)
+		if symbol, ok := g.Labels[b.Start]; ok {
+			name = symbol
+		}
+		fmt.Fprintf(&label, "%s:\\l", escape(name))
+		for offset := b.Start; offset < b.End; offset += code.InstructionWidth {
+			text, err := code.FormatInstruction(g.Instructions[offset:])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&label, "%04d  %s\\l", offset, text)
+		}
+
+		// Each line ends in \l to left align it
+		attrs := []string{fmt.Sprintf("label=\"%s\"", label.String())}
+		if b == g.Entry {
+			attrs = append(attrs, "penwidth=2")
+		}
+		if !b.Reachable {
+			attrs = append(attrs, "style=dashed")
+		}
+		if b.Unresolved {
+			attrs = append(attrs, "color=red")
+		}
+		fmt.Fprintf(out, "\tb%d [%s];\n", b.ID, strings.Join(attrs, " "))
+	}
+
+	for _, b := range g.Blocks {
+		for _, e := range b.Succs {
+			if e.Kind == Fallthrough {
+				fmt.Fprintf(out, "\tb%d -> b%d;\n", e.From.ID, e.To.ID)
+			} else {
+				fmt.Fprintf(out, "\tb%d -> b%d [label=%q];\n", e.From.ID, e.To.ID, e.Kind.String())
+			}
+		}
+	}
+	fmt.Fprintf(out, "}\n")
+
+	return out.Flush()
+}
+
+// Escapes s for a quoted DOT string
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -2,7 +2,9 @@ package code
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"simpsel/token"
 )
 
@@ -29,8 +31,175 @@ const (
 	OpLte // 0F
 	OpJmpe // 10
 	OpNop // 11
+	OpLb // 12
+	OpLw // 13
+	OpSb // 14
+	OpSw // 15
+	OpAlloc // 16
+	OpPush // 17
+	OpPop // 18
+	OpCall // 19
+	OpCalli // 1A
+	OpRet // 1B
+	OpLui // 1C
+	OpAnd // 1D
+	OpOr // 1E
+	OpXor // 1F
+	OpNot // 20
+	OpShl // 21
+	OpShr // 22
+	OpSar // 23
+	OpMod // 24
+	OpRem // 25
+	OpSeteq // 26
+	OpSetneq // 27
+	OpSetgt // 28
+	OpSetlt // 29
+	OpSetgte // 2A
+	OpSetlte // 2B
+	OpJmpne // 2C
+	OpJz // 2D
+	OpJnz // 2E
+	OpJn // 2F
+	OpJnn // 30
+	OpJc // 31
+	OpJnc // 32
+	OpJo // 33
+	OpJno // 34
+	OpAddi // 35
+	OpSubi // 36
+	OpMuli // 37
+	OpEqi // 38
+	OpNeqi // 39
+	OpGti // 3A
+	OpLti // 3B
+	OpGtei // 3C
+	OpLtei // 3D
+	OpCmpi // 3E
 )
 
+// Every instruction is an opcode followed by three bytes of operands
+const InstructionWidth = 4
+
+// Bumped whenever an opcode is added or changes meaning
+const ISAVersion = 6
+
+type OperandType int
+
+const (
+	Register  OperandType = iota // $10, stored in 1 byte
+	Immediate                    // #10, stored in 2 bytes
+	Address                      // @label, a code offset stored in 2 bytes
+)
+
+var operandWidths = map[OperandType]int{
+	Register:  1,
+	Immediate: 2,
+	Address:   2,
+}
+
+func (ot OperandType) Width() int {
+	return operandWidths[ot]
+}
+
+type Definition struct {
+	Name     string        // The mnemonic, ie `load`
+	Operands []OperandType // The operand layout after the opcode
+}
+
+var definitions = map[Opcode]*Definition{
+	OpLoad:   {"load", []OperandType{Register, Immediate}},
+	OpAdd:    {"add", []OperandType{Register, Register, Register}},
+	OpSub:    {"sub", []OperandType{Register, Register, Register}},
+	OpMul:    {"mul", []OperandType{Register, Register, Register}},
+	OpDiv:    {"div", []OperandType{Register, Register, Register}},
+	OpHlt:    {"hlt", []OperandType{}},
+	OpIgl:    {"igl", []OperandType{}},
+	OpJmp:    {"jmp", []OperandType{Register}},
+	OpJmpf:   {"jmpf", []OperandType{Register}},
+	OpJmpb:   {"jmpb", []OperandType{Register}},
+	OpEq:     {"eq", []OperandType{Register, Register}},
+	OpNeq:    {"neq", []OperandType{Register, Register}},
+	OpGt:     {"gt", []OperandType{Register, Register}},
+	OpLt:     {"lt", []OperandType{Register, Register}},
+	OpGte:    {"gte", []OperandType{Register, Register}},
+	OpLte:    {"lte", []OperandType{Register, Register}},
+	OpJmpe:   {"jmpe", []OperandType{Register}},
+	OpNop:    {"nop", []OperandType{}},
+	OpLb:     {"lb", []OperandType{Register, Register}},
+	OpLw:     {"lw", []OperandType{Register, Register}},
+	OpSb:     {"sb", []OperandType{Register, Register}},
+	OpSw:     {"sw", []OperandType{Register, Register}},
+	OpAlloc:  {"alloc", []OperandType{Register, Register}},
+	OpPush:   {"push", []OperandType{Register}},
+	OpPop:    {"pop", []OperandType{Register}},
+	OpCall:   {"call", []OperandType{Register}},
+	OpCalli:  {"call", []OperandType{Address}},
+	OpRet:    {"ret", []OperandType{}},
+	OpLui:    {"lui", []OperandType{Register, Immediate}},
+	OpAnd:    {"and", []OperandType{Register, Register, Register}},
+	OpOr:     {"or", []OperandType{Register, Register, Register}},
+	OpXor:    {"xor", []OperandType{Register, Register, Register}},
+	OpNot:    {"not", []OperandType{Register, Register}},
+	OpShl:    {"shl", []OperandType{Register, Register, Register}},
+	OpShr:    {"shr", []OperandType{Register, Register, Register}},
+	OpSar:    {"sar", []OperandType{Register, Register, Register}},
+	OpMod:    {"mod", []OperandType{Register, Register, Register}},
+	OpRem:    {"rem", []OperandType{Register}},
+	OpSeteq:  {"seteq", []OperandType{Register, Register, Register}},
+	OpSetneq: {"setneq", []OperandType{Register, Register, Register}},
+	OpSetgt:  {"setgt", []OperandType{Register, Register, Register}},
+	OpSetlt:  {"setlt", []OperandType{Register, Register, Register}},
+	OpSetgte: {"setgte", []OperandType{Register, Register, Register}},
+	OpSetlte: {"setlte", []OperandType{Register, Register, Register}},
+	OpJmpne:  {"jmpne", []OperandType{Register}},
+	OpJz:     {"jz", []OperandType{Register}},
+	OpJnz:    {"jnz", []OperandType{Register}},
+	OpJn:     {"jn", []OperandType{Register}},
+	OpJnn:    {"jnn", []OperandType{Register}},
+	OpJc:     {"jc", []OperandType{Register}},
+	OpJnc:    {"jnc", []OperandType{Register}},
+	OpJo:     {"jo", []OperandType{Register}},
+	OpJno:    {"jno", []OperandType{Register}},
+	OpAddi:   {"addi", []OperandType{Register, Immediate}},
+	OpSubi:   {"subi", []OperandType{Register, Immediate}},
+	OpMuli:   {"muli", []OperandType{Register, Immediate}},
+	OpEqi:    {"eqi", []OperandType{Register, Immediate}},
+	OpNeqi:   {"neqi", []OperandType{Register, Immediate}},
+	OpGti:    {"gti", []OperandType{Register, Immediate}},
+	OpLti:    {"lti", []OperandType{Register, Immediate}},
+	OpGtei:   {"gtei", []OperandType{Register, Immediate}},
+	OpLtei:   {"ltei", []OperandType{Register, Immediate}},
+	OpCmpi:   {"cmpi", []OperandType{Register, Immediate}},
+}
+
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %02X undefined", op)
+	}
+
+	return def, nil
+}
+
+// Decodes the operands following an opcode according to def
+func ReadOperands(def *Definition, ins Instructions) []int {
+	operands := make([]int, len(def.Operands))
+	offset := 0
+
+	for i, ot := range def.Operands {
+		switch ot.Width() {
+		case 1:
+			operands[i] = int(ins[offset])
+		case 2:
+			operands[i] = int(binary.LittleEndian.Uint16(ins[offset:]))
+		}
+		offset += ot.Width()
+	}
+
+	return operands
+}
+
 func (ins Instructions) String() string {
 	str := hex.EncodeToString(ins)
 	return splitNth(str, 2)
@@ -40,6 +209,8 @@ func FromToken(tok token.Token) Opcode {
 	switch tok.Type {
 	case token.LOAD:
 		return OpLoad
+	case token.LUI:
+		return OpLui
 	case token.ADD:
 		return OpAdd
 	case token.SUB:
@@ -74,6 +245,92 @@ func FromToken(tok token.Token) Opcode {
 		return OpJmpe
 	case token.NOP:
 		return OpNop
+	case token.LB:
+		return OpLb
+	case token.LW:
+		return OpLw
+	case token.SB:
+		return OpSb
+	case token.SW:
+		return OpSw
+	case token.ALLOC:
+		return OpAlloc
+	case token.PUSH:
+		return OpPush
+	case token.POP:
+		return OpPop
+	case token.CALL:
+		return OpCall
+	case token.RET:
+		return OpRet
+	case token.AND:
+		return OpAnd
+	case token.OR:
+		return OpOr
+	case token.XOR:
+		return OpXor
+	case token.NOT:
+		return OpNot
+	case token.SHL:
+		return OpShl
+	case token.SHR:
+		return OpShr
+	case token.SAR:
+		return OpSar
+	case token.MOD:
+		return OpMod
+	case token.REM:
+		return OpRem
+	case token.SETEQ:
+		return OpSeteq
+	case token.SETNEQ:
+		return OpSetneq
+	case token.SETGT:
+		return OpSetgt
+	case token.SETLT:
+		return OpSetlt
+	case token.SETGTE:
+		return OpSetgte
+	case token.SETLTE:
+		return OpSetlte
+	case token.JMPNE:
+		return OpJmpne
+	case token.JZ:
+		return OpJz
+	case token.JNZ:
+		return OpJnz
+	case token.JN:
+		return OpJn
+	case token.JNN:
+		return OpJnn
+	case token.JC:
+		return OpJc
+	case token.JNC:
+		return OpJnc
+	case token.JO:
+		return OpJo
+	case token.JNO:
+		return OpJno
+	case token.ADDI:
+		return OpAddi
+	case token.SUBI:
+		return OpSubi
+	case token.MULI:
+		return OpMuli
+	case token.EQI:
+		return OpEqi
+	case token.NEQI:
+		return OpNeqi
+	case token.GTI:
+		return OpGti
+	case token.LTI:
+		return OpLti
+	case token.GTEI:
+		return OpGtei
+	case token.LTEI:
+		return OpLtei
+	case token.CMPI:
+		return OpCmpi
 	default:
 		return OpIgl
 	}
@@ -0,0 +1,168 @@
+package code
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Turns instructions back into simpsel assembly that reassembles to the same bytes.
+// Each line ends with a comment holding its offset and encoded bytes.
+func Disassemble(ins Instructions) (string, error) {
+	return DisassembleLabeled(ins, nil)
+}
+
+// Like Disassemble, but also puts a label at each of the given offsets
+func DisassembleLabeled(ins Instructions, extraLabels []int) (string, error) {
+	return DisassembleAnnotated(ins, extraLabels, nil)
+}
+
+// Like DisassembleLabeled, but also puts a comment line holding notes[offset]
+// before the instruction at each offset
+func DisassembleAnnotated(ins Instructions, extraLabels []int, notes map[int]string) (string, error) {
+	if len(ins)%InstructionWidth != 0 {
+		return "", fmt.Errorf("program is %d bytes, not a multiple of %d",
+			len(ins), InstructionWidth)
+	}
+
+	labels, err := addressTargets(ins)
+	if err != nil {
+		return "", err
+	}
+	for _, offset := range extraLabels {
+		labels[offset] = true
+	}
+
+	var out bytes.Buffer
+
+	for offset := 0; offset < len(ins); offset += InstructionWidth {
+		if labels[offset] {
+			fmt.Fprintf(&out, "%s:\n", LabelName(offset))
+		}
+		if note, ok := notes[offset]; ok {
+			fmt.Fprintf(&out, "; %s\n", note)
+		}
+
+		def, err := Lookup(ins[offset])
+		if err != nil {
+			return "", fmt.Errorf("offset %d: %s", offset, err)
+		}
+
+		line := fmtInstruction(def, ReadOperands(def, ins[offset+1:]))
+		fmt.Fprintf(&out, "%-24s ; %04d: %s", line, offset,
+			ins[offset:offset+InstructionWidth])
+		if value, ok := wideLoad(ins, offset); ok && !labels[offset] {
+			fmt.Fprintf(&out, " = %d", value)
+		}
+		out.WriteString("\n")
+	}
+
+	if labels[len(ins)] {
+		fmt.Fprintf(&out, "%s:\n", LabelName(len(ins)))
+	}
+
+	return out.String(), nil
+}
+
+// Renders data as .byte directives, eight values per line
+func DisassembleData(data []byte) string {
+	var out bytes.Buffer
+
+	for offset := 0; offset < len(data); offset += 8 {
+		end := offset + 8
+		if end > len(data) {
+			end = len(data)
+		}
+
+		out.WriteString(".byte")
+		for i, b := range data[offset:end] {
+			if i == 0 {
+				out.WriteString(" ")
+			} else {
+				out.WriteString(", ")
+			}
+			fmt.Fprintf(&out, "#%d", b)
+		}
+		fmt.Fprintf(&out, " ; %04d\n", offset)
+	}
+
+	return out.String()
+}
+
+// Finds every offset that an Address operand points at, so it can be given a label
+func addressTargets(ins Instructions) (map[int]bool, error) {
+	targets := map[int]bool{}
+
+	for offset := 0; offset < len(ins); offset += InstructionWidth {
+		def, err := Lookup(ins[offset])
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %s", offset, err)
+		}
+
+		operands := ReadOperands(def, ins[offset+1:])
+		for i, ot := range def.Operands {
+			if ot != Address {
+				continue
+			}
+			target := operands[i]
+			if target%InstructionWidth != 0 || target > len(ins) {
+				return nil, fmt.Errorf("offset %d: target %d is not an instruction",
+					offset, target)
+			}
+			targets[target] = true
+		}
+	}
+
+	return targets, nil
+}
+
+// Works out the value loaded by a load and lui pair ending at offset, which is
+// how the assembler loads values that don't fit in 16 bits
+func wideLoad(ins Instructions, offset int) (int32, bool) {
+	if offset < InstructionWidth || Opcode(ins[offset]) != OpLui {
+		return 0, false
+	}
+	load := ins[offset-InstructionWidth:]
+	if Opcode(load[0]) != OpLoad || load[1] != ins[offset+1] {
+		return 0, false
+	}
+
+	lower := ReadOperands(definitions[OpLoad], load[1:])[1]
+	upper := ReadOperands(definitions[OpLui], ins[offset+1:])[1]
+	return int32(uint32(upper)<<16 | uint32(lower)), true
+}
+
+// Renders the single instruction at the start of ins, without a comment
+func FormatInstruction(ins Instructions) (string, error) {
+	if len(ins) < InstructionWidth {
+		return "", fmt.Errorf("instruction is %d bytes, expected %d", len(ins), InstructionWidth)
+	}
+	def, err := Lookup(ins[0])
+	if err != nil {
+		return "", err
+	}
+	return fmtInstruction(def, ReadOperands(def, ins[1:])), nil
+}
+
+func fmtInstruction(def *Definition, operands []int) string {
+	var out bytes.Buffer
+
+	out.WriteString(def.Name)
+
+	for i, ot := range def.Operands {
+		switch ot {
+		case Register:
+			fmt.Fprintf(&out, " $%d", operands[i])
+		case Immediate:
+			fmt.Fprintf(&out, " #%d", operands[i])
+		case Address:
+			fmt.Fprintf(&out, " @%s", LabelName(operands[i]))
+		}
+	}
+
+	return out.String()
+}
+
+// The name the disassembler gives the label at offset
+func LabelName(offset int) string {
+	return fmt.Sprintf("L%04d", offset)
+}
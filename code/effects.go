@@ -0,0 +1,73 @@
+package code
+
+// The registers an instruction reads and writes, given its decoded operands
+func RegisterEffects(op Opcode, operands []int) (reads, writes []int) {
+	switch op {
+	case OpLoad, OpPop, OpRem:
+		return nil, operands[:1]
+	case OpLui:
+		// Keeps the lower half of the register
+		return operands[:1], operands[:1]
+	case OpAddi, OpSubi, OpMuli:
+		return operands[:1], operands[:1]
+	case OpAdd, OpSub, OpMul, OpDiv, OpAnd, OpOr, OpXor, OpShl, OpShr, OpSar, OpMod,
+		OpSeteq, OpSetneq, OpSetgt, OpSetlt, OpSetgte, OpSetlte:
+		return operands[:2], operands[2:3]
+	case OpJmp, OpJmpf, OpJmpb, OpJmpe, OpJmpne, OpJz, OpJnz, OpJn, OpJnn, OpJc, OpJnc, OpJo, OpJno, OpPush, OpCall:
+		return operands[:1], nil
+	case OpEq, OpNeq, OpGt, OpLt, OpGte, OpLte, OpSb, OpSw:
+		return operands[:2], nil
+	case OpEqi, OpNeqi, OpGti, OpLti, OpGtei, OpLtei, OpCmpi:
+		return operands[:1], nil
+	case OpLb, OpLw, OpAlloc, OpNot:
+		return operands[:1], operands[1:2]
+	}
+	return nil, nil
+}
+
+// Whether op sets the equal flag that jmpe tests
+func IsCompare(op Opcode) bool {
+	switch op {
+	case OpEq, OpNeq, OpGt, OpLt, OpGte, OpLte, OpEqi, OpNeqi, OpGti, OpLti, OpGtei, OpLtei:
+		return true
+	}
+	return false
+}
+
+// Whether op jumps or carries on depending on a flag
+func IsBranch(op Opcode) bool {
+	return op == OpJmpe || op == OpJmpne || ReadsFlags(op)
+}
+
+// Whether op jumps to the code offset held in its register
+func JumpsToRegister(op Opcode) bool {
+	return op == OpJmp || op == OpCall || IsBranch(op)
+}
+
+// Whether op updates the Z, N, C and V flags
+func SetsFlags(op Opcode) bool {
+	switch op {
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpAnd, OpOr, OpXor, OpNot, OpShl, OpShr, OpSar,
+		OpAddi, OpSubi, OpMuli, OpCmpi:
+		return true
+	}
+	return IsCompare(op)
+}
+
+// Whether op is a jump on one of the Z, N, C and V flags
+func ReadsFlags(op Opcode) bool {
+	switch op {
+	case OpJz, OpJnz, OpJn, OpJnn, OpJc, OpJnc, OpJo, OpJno:
+		return true
+	}
+	return false
+}
+
+// Whether execution never carries on to the instruction after op
+func IsTerminator(op Opcode) bool {
+	switch op {
+	case OpHlt, OpIgl, OpJmp, OpJmpf, OpJmpb, OpRet:
+		return true
+	}
+	return false
+}
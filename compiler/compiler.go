@@ -2,37 +2,179 @@ package compiler
 
 import (
 	"encoding/binary"
+	"math"
 	"simpsel/ast"
 	"simpsel/code"
+	"simpsel/diag"
+	"simpsel/token"
 )
 
+// A label reference, or an expression using labels, waiting to be patched once every label is known
+type fixup struct {
+	section  Section // Section the operand lives in
+	position int     // Position of the operand inside the section
+	width    int     // Width of the operand in bytes
+	expr     ast.Expression
+	field    field // The range an expression's value must fall in
+}
+
 type Compiler struct {
 	instructions code.Instructions
+	data         []byte
+	section      Section
+	symbols      *SymbolTable
+	fixups       []fixup
+	entry        *ast.LabelReference
+	scratch      uint8
+	expansions   []Expansion
+	mappings     []mapping
+	optimize     bool
+	stats        OptimizeStats
+	codeBase     int
+	dataBase     int
+}
+
+// Settings for the compiler, usually from the command line
+type Options struct {
+	ScratchRegister uint8 // Clobbered by pseudo-instructions, New uses DefaultScratchRegister
+	Optimize        bool  // Run the peephole optimiser over the code
+	CodeBase        int   // Where the code will be loaded, for adding to a program that's already running
+	DataBase        int   // Where the data will be loaded, likewise
 }
 
 func New() *Compiler {
+	return NewWithOptions(Options{ScratchRegister: DefaultScratchRegister})
+}
+
+func NewWithOptions(opts Options) *Compiler {
 	return &Compiler{
 		instructions: code.Instructions{},
+		data:         []byte{},
+		section:      CodeSection,
+		symbols:      NewSymbolTable(),
+		fixups:       []fixup{},
+		scratch:      opts.ScratchRegister,
+		optimize:     opts.Optimize,
+		codeBase:     opts.CodeBase,
+		dataBase:     opts.DataBase,
 	}
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
 	switch node := node.(type) {
 	case *ast.Program:
+		// First pass: emit code and collect the label symbols
 		for _, i := range node.Instructions {
+			section, offset := c.section, c.sectionOffset()
 			err := c.Compile(i)
 			if err != nil {
 				return err
 			}
+			if _, ok := i.(*ast.SectionDirective); ok {
+				section, offset = c.section, c.sectionOffset()
+			}
+			c.mappings = append(c.mappings, mapping{
+				node:    i,
+				section: section,
+				offset:  offset,
+				length:  len(c.sectionBytes(section)) - offset,
+			})
+		}
+
+		if c.optimize {
+			c.optimizeCode()
 		}
 
+		// Second pass: patch the label references
+		return c.patchLabels()
+
+	case *ast.EntryDirective:
+		c.entry = node.Label
+
+	case *ast.LabelDeclaration:
+		if sym, ok := c.symbols.Resolve(node.Name); ok {
+			return diag.Errorf(node.Token, "label %q already defined on line %d",
+				node.Name, sym.Line)
+		}
+		c.symbols.Define(node.Name, c.section, c.sectionOffset(), node.Token.Line)
+
+	case *ast.SectionDirective:
+		switch node.Token.Type {
+		case token.CODE:
+			c.section = CodeSection
+		case token.DATA:
+			c.section = DataSection
+		}
+
+	case *ast.DataDirective:
+		if c.section != DataSection {
+			return diag.Errorf(node.Token, ".%s is only allowed in the .data section",
+				node.Token.Literal)
+		}
+		f := byteField
+		switch node.Token.Type {
+		case token.WORD:
+			f = wordField
+		case token.SPACE:
+			f = spaceField
+		}
+		for i, value := range node.Values {
+			folded, err := c.fold(value, f)
+			if err != nil {
+				return err
+			}
+			if node.Token.Type == token.SPACE && usesLabels(folded) {
+				return diag.Errorf(firstToken(folded), "a .space size can't depend on a label")
+			}
+			node.Values[i] = folded
+		}
+		c.emitData(node)
+
 	case *ast.AssemblerInstruction:
-		c.emit(code.FromToken(node.Opcode), node.Operand1, node.Operand2, node.Operand3)
+		if c.section != CodeSection {
+			return diag.Errorf(node.Opcode, "instruction %q is only allowed in the .code section",
+				node.Opcode.Literal)
+		}
+		if isPseudo(node) {
+			return c.emitPseudo(node)
+		}
+		op := code.FromToken(node.Opcode)
+		if _, ok := node.Operand1.(*ast.LabelReference); ok && op == code.OpCall {
+			op = code.OpCalli
+		}
+		operand2 := node.Operand2
+		if f, ok := immediateFields[op]; ok {
+			var err error
+			if operand2, err = c.fold(operand2, f); err != nil {
+				return err
+			}
+		}
+		if lit, ok := operand2.(*ast.IntegerLiteral); ok && op == code.OpLoad {
+			c.emitLoad(node.Operand1, lit)
+			return nil
+		}
+		c.emit(op, node.Operand1, operand2, node.Operand3)
 	}
 
 	return nil
 }
 
+// The field each instruction with an immediate operand encodes it in
+var immediateFields = map[code.Opcode]field{
+	code.OpLoad: loadField,
+	code.OpLui:  luiField,
+	code.OpAddi: immField,
+	code.OpSubi: immField,
+	code.OpMuli: immField,
+	code.OpEqi:  immField,
+	code.OpNeqi: immField,
+	code.OpGti:  immField,
+	code.OpLti:  immField,
+	code.OpGtei: immField,
+	code.OpLtei: immField,
+	code.OpCmpi: immField,
+}
+
 func (c *Compiler) emit(op code.Opcode, operands ...ast.Expression) int {
 	ins := make([]byte, 4)
 
@@ -48,7 +190,28 @@ func (c *Compiler) emit(op code.Opcode, operands ...ast.Expression) int {
 		switch operand := operand.(type) {
 		case *ast.IntegerLiteral:
 			if len(ins)-p > 1 {
-				binary.LittleEndian.PutUint16(ins[p:], operand.Value)
+				binary.LittleEndian.PutUint16(ins[p:], uint16(operand.Value))
+				p += 2
+			}
+		case *ast.LabelReference:
+			if len(ins)-p > 1 {
+				c.fixups = append(c.fixups, fixup{
+					section:  CodeSection,
+					position: len(c.instructions) + p,
+					width:    2,
+					expr:     operand,
+				})
+				p += 2
+			}
+		case *ast.PrefixExpression, *ast.InfixExpression, *ast.CallExpression:
+			if len(ins)-p > 1 {
+				c.fixups = append(c.fixups, fixup{
+					section:  CodeSection,
+					position: len(c.instructions) + p,
+					width:    2,
+					expr:     operand,
+					field:    shortField,
+				})
 				p += 2
 			}
 		case *ast.RegisterLiteral:
@@ -63,6 +226,128 @@ func (c *Compiler) emit(op code.Opcode, operands ...ast.Expression) int {
 	return pos
 }
 
+// A load immediate only holds 16 bits, so a value that doesn't fit becomes a
+// load of the lower half followed by a lui of the upper half.
+func (c *Compiler) emitLoad(register ast.Expression, lit *ast.IntegerLiteral) {
+	if lit.Value >= 0 && lit.Value <= math.MaxUint16 {
+		c.emit(code.OpLoad, register, lit)
+		return
+	}
+
+	value := uint32(lit.Value)
+	lower := &ast.IntegerLiteral{Token: lit.Token, Value: int64(value & 0xFFFF)}
+	upper := &ast.IntegerLiteral{Token: lit.Token, Value: int64(value >> 16)}
+	c.emit(code.OpLoad, register, lower)
+	c.emit(code.OpLui, register, upper)
+}
+
+func (c *Compiler) emitData(node *ast.DataDirective) {
+	for _, value := range node.Values {
+		switch value := value.(type) {
+		case *ast.IntegerLiteral:
+			switch node.Token.Type {
+			case token.BYTE:
+				c.data = append(c.data, byte(value.Value))
+			case token.WORD:
+				word := make([]byte, 4)
+				binary.LittleEndian.PutUint32(word, uint32(value.Value))
+				c.data = append(c.data, word...)
+			case token.SPACE:
+				c.data = append(c.data, make([]byte, value.Value)...)
+			}
+		case *ast.LabelReference:
+			c.fixups = append(c.fixups, fixup{
+				section:  DataSection,
+				position: len(c.data),
+				width:    4,
+				expr:     value,
+			})
+			c.data = append(c.data, make([]byte, 4)...)
+		case *ast.PrefixExpression, *ast.InfixExpression, *ast.CallExpression:
+			f := fixup{section: DataSection, position: len(c.data), width: 1, expr: value, field: byteField}
+			if node.Token.Type == token.WORD {
+				f.width, f.field = 4, wordField
+			}
+			c.fixups = append(c.fixups, f)
+			c.data = append(c.data, make([]byte, f.width)...)
+		case *ast.StringLiteral:
+			c.data = append(c.data, value.Value...)
+			c.data = append(c.data, 0)
+		}
+	}
+}
+
+func (c *Compiler) sectionOffset() int {
+	if c.section == DataSection {
+		return len(c.data)
+	}
+	return len(c.instructions)
+}
+
+func (c *Compiler) patchLabels() error {
+	for _, f := range c.fixups {
+		label, ok := f.expr.(*ast.LabelReference)
+		if !ok {
+			value, err := c.evaluate(f.expr)
+			if err != nil {
+				return err
+			}
+			if err := f.field.check(f.expr, value); err != nil {
+				return err
+			}
+			putValue(c.sectionBytes(f.section)[f.position:], f.width, value)
+			continue
+		}
+
+		sym, ok := c.symbols.Resolve(label.Name)
+		if !ok {
+			return diag.Errorf(label.Token, "undefined label %q", label.Name)
+		}
+
+		address := c.address(sym)
+		switch f.width {
+		case 2:
+			if address > math.MaxUint16 {
+				return diag.Errorf(label.Token, "label %q at offset %d does not fit in 16 bits",
+					label.Name, address)
+			}
+			binary.LittleEndian.PutUint16(c.sectionBytes(f.section)[f.position:], uint16(address))
+		case 4:
+			binary.LittleEndian.PutUint32(c.sectionBytes(f.section)[f.position:], uint32(address))
+		}
+	}
+	c.fixups = []fixup{}
+
+	if c.entry != nil {
+		sym, ok := c.symbols.Resolve(c.entry.Name)
+		if !ok {
+			return diag.Errorf(c.entry.Token, "undefined label %q", c.entry.Name)
+		}
+		if sym.Section != CodeSection {
+			return diag.Errorf(c.entry.Token, "entry point %q is not in the .code section",
+				c.entry.Name)
+		}
+	}
+
+	return nil
+}
+
+// The value a label stands for, its offset in the section once loaded after
+// anything already there
+func (c *Compiler) address(sym Symbol) int {
+	if sym.Section == CodeSection {
+		return c.codeBase + sym.Offset
+	}
+	return c.dataBase + sym.Offset
+}
+
+func (c *Compiler) sectionBytes(section Section) []byte {
+	if section == DataSection {
+		return c.data
+	}
+	return c.instructions
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
 	posNewInstruction := len(c.instructions)
 	c.instructions = append(c.instructions, ins...)
@@ -70,11 +355,28 @@ func (c *Compiler) addInstruction(ins []byte) int {
 }
 
 func (c *Compiler) Bytecode() *Bytecode {
-	return &Bytecode{
+	bytecode := &Bytecode{
 		Instructions: c.instructions,
+		Data:         c.data,
+		Symbols:      c.symbols.All(),
+		Expansions:   c.expansions,
+		SourceMap:    c.sourceMap(),
 	}
+
+	if c.entry != nil {
+		if sym, ok := c.symbols.Resolve(c.entry.Name); ok {
+			bytecode.Entry = sym.Offset
+		}
+	}
+
+	return bytecode
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
+	Data         []byte       // Initial contents of the VM's memory
+	Entry        int          // Offset of the first instruction to run
+	Symbols      []Symbol     // The labels, for tools. Not needed to run the program
+	Expansions   []Expansion  // Where pseudo-instructions were expanded, for tools
+	SourceMap    []SourceLine // The source line of each instruction, for error messages
 }
@@ -0,0 +1,956 @@
+package compiler
+
+import (
+	"bytes"
+	"simpsel/ast"
+	"simpsel/code"
+	"simpsel/diag"
+	"simpsel/lexer"
+	"simpsel/parser"
+	"strings"
+	"testing"
+)
+
+type compilerTestCase struct {
+	input                string
+	expectedInstructions []code.Instructions
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
+
+func runCompilerTests(t *testing.T, tests []compilerTestCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		expected := concatInstructions(tt.expectedInstructions)
+		actual := compiler.Bytecode().Instructions
+		if actual.String() != expected.String() {
+			t.Errorf("wrong instructions for %q.\nwant=%q\ngot =%q",
+				tt.input, expected, actual)
+		}
+	}
+}
+
+func concatInstructions(s []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+
+	for _, ins := range s {
+		out = append(out, ins...)
+	}
+
+	return out
+}
+
+func TestLabels(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			"start:\nload $31 @start\njmp $31",
+			[]code.Instructions{
+				{byte(code.OpLoad), 31, 0, 0},
+				{byte(code.OpJmp), 31, 0, 0},
+			},
+		},
+		{
+			"load $31 @end\njmp $31\nnop\nend:\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 31, 12, 0},
+				{byte(code.OpJmp), 31, 0, 0},
+				{byte(code.OpNop), 0, 0, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestLabelErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"load $31 @nowhere", `1:10: error: undefined label "nowhere"`},
+		{"a:\nnop\na:", `3:1: error: label "a" already defined on line 1`},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestDataSection(t *testing.T) {
+	program := parse(`.data
+nums: .byte #1, #2
+msg: .asciiz "hi"
+ptr: .word @msg
+.space #2
+.code
+load $0 @ptr
+hlt`)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	expectedData := []byte{1, 2, 'h', 'i', 0, 2, 0, 0, 0, 0, 0}
+	if string(bytecode.Data) != string(expectedData) {
+		t.Errorf("wrong data.\nwant=%v\ngot =%v", expectedData, bytecode.Data)
+	}
+
+	expected := concatInstructions([]code.Instructions{
+		{byte(code.OpLoad), 0, 5, 0},
+		{byte(code.OpHlt), 0, 0, 0},
+	})
+	if bytecode.Instructions.String() != expected.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot =%q",
+			expected, bytecode.Instructions)
+	}
+}
+
+func TestSectionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{".byte #1", "1:1: error: .byte is only allowed in the .data section"},
+		{".data\nhlt", `2:1: error: instruction "hlt" is only allowed in the .code section`},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			"call $1\nret",
+			[]code.Instructions{
+				{byte(code.OpCall), 1, 0, 0},
+				{byte(code.OpRet), 0, 0, 0},
+			},
+		},
+		{
+			"call @sub\nhlt\nsub:\nret",
+			[]code.Instructions{
+				{byte(code.OpCalli), 8, 0, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+				{byte(code.OpRet), 0, 0, 0},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWideLoad(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			"load $1 #65535",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 0xFF, 0xFF},
+			},
+		},
+		{
+			"load $1 #65536",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 0, 0},
+				{byte(code.OpLui), 1, 1, 0},
+			},
+		},
+		{
+			"load $2 #-2",
+			[]code.Instructions{
+				{byte(code.OpLoad), 2, 0xFE, 0xFF},
+				{byte(code.OpLui), 2, 0xFF, 0xFF},
+			},
+		},
+		{
+			"load $3 #0x12345678\nload $31 @end\nend:",
+			[]code.Instructions{
+				{byte(code.OpLoad), 3, 0x78, 0x56},
+				{byte(code.OpLui), 3, 0x34, 0x12},
+				{byte(code.OpLoad), 31, 12, 0},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestImmediateForms(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			"add $2 #1 $2\nsub $3 #0xFFFF $3\nmul $4 #(2 * 3) $4",
+			[]code.Instructions{
+				{byte(code.OpAddi), 2, 1, 0},
+				{byte(code.OpSubi), 3, 0xFF, 0xFF},
+				{byte(code.OpMuli), 4, 6, 0},
+			},
+		},
+		{
+			"addi $2 #1\nsubi $2 #2\nmuli $2 #3",
+			[]code.Instructions{
+				{byte(code.OpAddi), 2, 1, 0},
+				{byte(code.OpSubi), 2, 2, 0},
+				{byte(code.OpMuli), 2, 3, 0},
+			},
+		},
+		{
+			"eq $0 #1\nneq $0 #2\ngt $0 #3\nlt $0 #4\ngte $0 #5\nlte $0 #6\ncmpi $0 #65535",
+			[]code.Instructions{
+				{byte(code.OpEqi), 0, 1, 0},
+				{byte(code.OpNeqi), 0, 2, 0},
+				{byte(code.OpGti), 0, 3, 0},
+				{byte(code.OpLti), 0, 4, 0},
+				{byte(code.OpGtei), 0, 5, 0},
+				{byte(code.OpLtei), 0, 6, 0},
+				{byte(code.OpCmpi), 0, 0xFF, 0xFF},
+			},
+		},
+		{
+			"addi $1 @end\nlt $1 (@end + 4)\nend:",
+			[]code.Instructions{
+				{byte(code.OpAddi), 1, 8, 0},
+				{byte(code.OpLti), 1, 12, 0},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestCodeBase(t *testing.T) {
+	input := "nop\nhere:\nload $1 @here\nload $2 (@here + 4)\ncall @here\n.data\nptr: .word @here"
+
+	compiler := NewWithOptions(Options{ScratchRegister: DefaultScratchRegister, CodeBase: 100})
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := concatInstructions([]code.Instructions{
+		{byte(code.OpNop), 0, 0, 0},
+		{byte(code.OpLoad), 1, 104, 0},
+		{byte(code.OpLoad), 2, 108, 0},
+		{byte(code.OpCalli), 104, 0, 0},
+	})
+	bytecode := compiler.Bytecode()
+	if bytecode.Instructions.String() != expected.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot =%q", expected, bytecode.Instructions)
+	}
+	if !bytes.Equal(bytecode.Data, []byte{104, 0, 0, 0}) {
+		t.Errorf("wrong data. got=%v", bytecode.Data)
+	}
+	// The symbol table stays relative to this code
+	if sym, ok := compiler.symbols.Resolve("here"); !ok || sym.Offset != 4 {
+		t.Errorf("wrong symbol for here. got=%+v", sym)
+	}
+}
+
+func TestDataBase(t *testing.T) {
+	input := "load $1 @msg\nload $2 (@msg + 1)\n.data\npad: .byte #0\nmsg: .asciiz \"hi\"\nptr: .word @msg"
+
+	compiler := NewWithOptions(Options{ScratchRegister: DefaultScratchRegister, DataBase: 3})
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := concatInstructions([]code.Instructions{
+		{byte(code.OpLoad), 1, 4, 0},
+		{byte(code.OpLoad), 2, 5, 0},
+	})
+	bytecode := compiler.Bytecode()
+	if bytecode.Instructions.String() != expected.String() {
+		t.Errorf("wrong instructions.\nwant=%q\ngot =%q", expected, bytecode.Instructions)
+	}
+	if !bytes.Equal(bytecode.Data, []byte{0, 'h', 'i', 0, 4, 0, 0, 0}) {
+		t.Errorf("wrong data. got=%v", bytecode.Data)
+	}
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	input := `load $1 #1
+load $0 #65535
+load $7 #-1
+load $8 #0x12345678
+load $31 @loop
+loop:
+add $2 $1 $2
+neq $0 $2
+jmpe $31
+call @sub
+push $2
+pop $3
+igl
+hlt
+sub:
+load $4 #4
+alloc $4 $5
+sw $2 $5
+lw $5 $6
+and $5 $6 $7
+or $5 $6 $7
+xor $5 $6 $7
+not $7 $8
+shl $8 $1 $9
+shr $8 $1 $9
+sar $8 $1 $9
+mod $9 $1 $10
+div $9 $1 $10
+rem $11
+seteq $1 $2 $12
+setneq $1 $2 $12
+setgt $1 $2 $12
+setlt $1 $2 $12
+setgte $1 $2 $12
+setlte $1 $2 $12
+jmpne $31
+jz $31
+jnz $31
+jn $31
+jnn $31
+jc $31
+jnc $31
+jo $31
+jno $31
+add $2 #1 $2
+sub $2 #0xFFFF $2
+mul $2 #3 $2
+addi $3 #7
+eq $2 #10
+neq $2 #10
+gt $2 #10
+lt $2 #10
+gte $2 #10
+lte $2 #10
+cmpi $0 #65535
+ret`
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	expected := compiler.Bytecode().Instructions
+
+	listing, err := code.Disassemble(expected)
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+
+	compiler = New()
+	if err := compiler.Compile(parse(listing)); err != nil {
+		t.Fatalf("compiler error on disassembly: %s\n%s", err, listing)
+	}
+	actual := compiler.Bytecode().Instructions
+
+	if actual.String() != expected.String() {
+		t.Errorf("disassembly did not reassemble to the same bytes.\nwant=%q\ngot =%q\n%s",
+			expected, actual, listing)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	ins := concatInstructions([]code.Instructions{
+		{byte(code.OpLoad), 1, 0x10, 0x01},
+		{byte(code.OpCalli), 12, 0, 0},
+		{byte(code.OpHlt), 0, 0, 0},
+		{byte(code.OpRet), 0, 0, 0},
+	})
+
+	expected := `load $1 #272             ; 0000: 00 01 10 01
+call @L0012              ; 0004: 1a 0c 00 00
+hlt                      ; 0008: 05 00 00 00
+L0012:
+ret                      ; 0012: 1b 00 00 00
+`
+
+	listing, err := code.Disassemble(ins)
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+
+	if listing != expected {
+		t.Errorf("wrong disassembly.\nwant=%q\ngot =%q", expected, listing)
+	}
+
+	listing, err = code.Disassemble(concatInstructions([]code.Instructions{
+		{byte(code.OpLoad), 2, 0xFE, 0xFF},
+		{byte(code.OpLui), 2, 0xFF, 0xFF},
+	}))
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+	expected = `load $2 #65534           ; 0000: 00 02 fe ff
+lui $2 #65535            ; 0004: 1c 02 ff ff = -2
+`
+	if listing != expected {
+		t.Errorf("wrong disassembly.\nwant=%q\ngot =%q", expected, listing)
+	}
+
+	listing, err = code.DisassembleAnnotated(concatInstructions([]code.Instructions{
+		{byte(code.OpLoad), 30, 1, 0},
+		{byte(code.OpAdd), 1, 30, 1},
+	}), nil, map[int]string{0: "inc $1 (pseudo-instruction)"})
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+	expected = `; inc $1 (pseudo-instruction)
+load $30 #1              ; 0000: 00 1e 01 00
+add $1 $30 $1            ; 0004: 01 01 1e 01
+`
+	if listing != expected {
+		t.Errorf("wrong disassembly.\nwant=%q\ngot =%q", expected, listing)
+	}
+
+	if _, err := code.Disassemble(code.Instructions{0x7F, 0, 0, 0}); err == nil {
+		t.Errorf("expected an error for an undefined opcode")
+	}
+}
+
+func TestEntry(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse("nop\nstart:\nhlt\n.entry @start"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	if entry := compiler.Bytecode().Entry; entry != 4 {
+		t.Errorf("wrong entry point. want=%d, got=%d", 4, entry)
+	}
+
+	compiler = New()
+	err = compiler.Compile(parse(".data\nv: .byte #1\n.code\n.entry @v"))
+	if err == nil {
+		t.Errorf("expected an error for an entry point in .data")
+	}
+}
+
+func TestNegativeData(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse(".data\n.byte #-1, #'A'\n.word #-2"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []byte{0xFF, 'A', 0xFE, 0xFF, 0xFF, 0xFF}
+	if data := compiler.Bytecode().Data; string(data) != string(expected) {
+		t.Errorf("wrong data.\nwant=%v\ngot =%v", expected, data)
+	}
+}
+
+func TestConstantExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			".equ SIZE #8\nload $1 #(SIZE*4+1)\nload $2 #((1 << 4) | 3 & 1)",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 33, 0},
+				{byte(code.OpLoad), 2, 17, 0},
+			},
+		},
+		{
+			// Folded expressions are loaded like literals, wide ones in two halves
+			"load $1 #(0x12345678 % 0x10000000)\nlui $1 #HIGH(-1)",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 0x78, 0x56},
+				{byte(code.OpLui), 1, 0x34, 0x02},
+				{byte(code.OpLui), 1, 0xFF, 0xFF},
+			},
+		},
+		{
+			"start:\nload $1 #(@end - @start)\nload $2 #LOW(@end)\nend:\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 8, 0},
+				{byte(code.OpLoad), 2, 8, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestDataExpressions(t *testing.T) {
+	program := parse(`.data
+a: .byte #(@b - @a), #(-2)
+b: .word #(@b * 256)
+.space #(2 - 1)`)
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []byte{2, 0xFE, 0, 2, 0, 0, 0}
+	if string(compiler.Bytecode().Data) != string(expected) {
+		t.Errorf("wrong data.\nwant=%v\ngot =%v", expected, compiler.Bytecode().Data)
+	}
+}
+
+func TestConstantExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"load $1 #(1 / 0)", "1:13: error: division by zero in constant expression"},
+		{"load $1 #(7 % (2 - 2))", "1:13: error: division by zero in constant expression"},
+		{"load $1 #(1 << 64)", "1:13: error: can't shift by 64, must be between 0 and 63"},
+		{"load $1 #(0x7FFFFFFFFFFFFFFF + 1)", "1:30: error: constant expression overflows"},
+		{"load $1 #(0xFFFFFFFF + 1)", "1:11: error: value 4294967296 does not fit in a load immediate, must be between -2147483648 and 4294967295"},
+		{"lui $1 #(-1)", "1:10: error: value -1 does not fit in a lui immediate, must be between 0 and 65535"},
+		{"load $1 #(@end - 8)\nend:", "1:11: error: value -4 does not fit in a 16 bit immediate, must be between 0 and 65535"},
+		{"load $1 #(@nowhere + 1)", `1:11: error: undefined label "nowhere"`},
+		{"add $1 #(0x10000) $1", "1:10: error: value 65536 does not fit in an immediate operand, must be between 0 and 65535"},
+		{"cmpi $1 #(-1)", "1:11: error: value -1 does not fit in an immediate operand, must be between 0 and 65535"},
+		{".data\na: .byte #(@a + 256)", "2:12: error: value 256 does not fit in a byte, must be between -128 and 255"},
+		{".data\na: .space #(@a + 1)", "2:13: error: a .space size can't depend on a label"},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestPseudoInstructions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			"mov $1 $2\nclr $3",
+			[]code.Instructions{
+				{byte(code.OpLoad), 30, 0, 0},
+				{byte(code.OpAdd), 2, 30, 1},
+				{byte(code.OpLoad), 3, 0, 0},
+			},
+		},
+		{
+			"inc $4\ndec $5",
+			[]code.Instructions{
+				{byte(code.OpLoad), 30, 1, 0},
+				{byte(code.OpAdd), 4, 30, 4},
+				{byte(code.OpLoad), 30, 1, 0},
+				{byte(code.OpSub), 5, 30, 5},
+			},
+		},
+		{
+			"start:\njmpz $1 @end\njmp @start\nend:\njmp $2",
+			[]code.Instructions{
+				{byte(code.OpLoad), 30, 0, 0},
+				{byte(code.OpEq), 1, 30, 0},
+				{byte(code.OpLoad), 30, 24, 0},
+				{byte(code.OpJmpe), 30, 0, 0},
+				{byte(code.OpLoad), 30, 0, 0},
+				{byte(code.OpJmp), 30, 0, 0},
+				{byte(code.OpJmp), 2, 0, 0},
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestPseudoInstructionExpansions(t *testing.T) {
+	compiler := NewWithOptions(Options{ScratchRegister: 7})
+	err := compiler.Compile(parse("nop\ninc $1\njmp @end\nend:\nclr $7"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+	expected := []Expansion{
+		{Offset: 4, Length: 8, Source: "inc $1"},
+		{Offset: 12, Length: 8, Source: "jmp @end"},
+		{Offset: 20, Length: 4, Source: "clr $7"},
+	}
+	if len(bytecode.Expansions) != len(expected) {
+		t.Fatalf("wrong number of expansions. want=%d, got=%d", len(expected), len(bytecode.Expansions))
+	}
+	for i, exp := range expected {
+		if bytecode.Expansions[i] != exp {
+			t.Errorf("expansions[%d] wrong. want=%+v, got=%+v", i, exp, bytecode.Expansions[i])
+		}
+	}
+
+	if bytecode.Instructions[5] != 7 {
+		t.Errorf("inc used the wrong scratch register. want=$7, got=$%d", bytecode.Instructions[5])
+	}
+}
+
+func TestPseudoInstructionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"inc $30", "1:5: error: inc can't use $30, it's the scratch register"},
+		{"mov $1 $30", "1:8: error: mov can't use $30, it's the scratch register"},
+		{"jmpz $30 @end\nend:", "1:6: error: jmpz can't use $30, it's the scratch register"},
+		{"jmp @nowhere", `1:5: error: undefined label "nowhere"`},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+
+		if !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	input := `.data
+msg: .asciiz "hello!!!!"
+.code
+start: load $1 @msg ; pointer
+inc $1
+  hlt`
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out strings.Builder
+	if err := compiler.WriteListing(&out, diag.Sources{"": input}); err != nil {
+		t.Fatalf("listing error: %s", err)
+	}
+
+	expected := `SECT OFFS  BYTES                    LINE             SOURCE
+DATA 0000                           1                .data
+DATA 0000  68 65 6c 6c 6f 21 21 21  2                msg: .asciiz "hello!!!!"
+DATA 0008  21 00
+CODE 0000                           3                .code
+CODE 0000  00 01 00 00              4                start: load $1 @msg ; pointer    ; @msg = 0
+CODE 0004                           5                inc $1
+CODE 0004  00 1e 01 00                                 + load $30 #1
+CODE 0008  01 01 1e 01                                 + add $1 $30 $1
+CODE 0012  05 00 00 00              6                hlt
+
+SYMBOLS
+CODE 0000  start (line 4)
+DATA 0000  msg (line 2)
+`
+	if out.String() != expected {
+		t.Errorf("wrong listing.\nwant=%q\ngot =%q", expected, out.String())
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse(".data\n.byte #1\n.code\nstart:\nload $1 #70000\n\nhlt"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := []SourceLine{
+		{Offset: 0, Length: 8, Line: 5},
+		{Offset: 8, Length: 4, Line: 7},
+	}
+	sourceMap := compiler.Bytecode().SourceMap
+	if len(sourceMap) != len(expected) {
+		t.Fatalf("wrong source map. want=%+v, got=%+v", expected, sourceMap)
+	}
+	for i, line := range expected {
+		if sourceMap[i] != line {
+			t.Errorf("sourceMap[%d] wrong. want=%+v, got=%+v", i, line, sourceMap[i])
+		}
+	}
+
+	tests := []struct {
+		offset int
+		line   int
+	}{
+		{0, 5},
+		{4, 5},
+		{8, 7},
+		{12, 0},
+		{-4, 0},
+	}
+	for _, tt := range tests {
+		line, ok := Locate(sourceMap, tt.offset)
+		if ok != (tt.line != 0) || line.Line != tt.line {
+			t.Errorf("Locate(%d) wrong. want=%d, got=%d (%t)", tt.offset, tt.line, line.Line, ok)
+		}
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			"nop\nload $1 #1\nload $1 #2\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 2, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			"load $1 #2\nload $2 #3\nadd $1 $2 $3\nmul $3 $2 $4\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 2, 0},
+				{byte(code.OpLoad), 2, 3, 0},
+				{byte(code.OpLoad), 3, 5, 0},
+				{byte(code.OpLoad), 4, 15, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			// Too big for a single load
+			"load $1 #300\nmul $1 $1 $2\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 44, 1},
+				{byte(code.OpMul), 1, 1, 2},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			// The add's flags are tested, so it has to stay
+			"load $1 #2\nload $2 #3\nadd $1 $2 $3\nload $31 @end\njc $31\nload $5 #1\nend:\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 2, 0},
+				{byte(code.OpLoad), 2, 3, 0},
+				{byte(code.OpAdd), 1, 2, 3},
+				{byte(code.OpLoad), 31, 24, 0},
+				{byte(code.OpJc), 31, 0, 0},
+				{byte(code.OpLoad), 5, 1, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			"load $1 #2\naddi $1 #3\nmul $1 #4 $1\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 20, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			// An immediate that's a label isn't known until the code stops moving
+			"load $1 #0\naddi $1 @end\nhlt\nend:",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 0, 0},
+				{byte(code.OpAddi), 1, 12, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			"mov $1 $1\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 30, 0, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			"jmp @next\nnext:\nhlt",
+			[]code.Instructions{
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			"jmpz $1 @next\nnext:\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 30, 0, 0},
+				{byte(code.OpEq), 1, 30, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			// Only the jump goes, $31 might be used afterwards
+			"load $31 @next\njmp $31\nnext:\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 31, 4, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			"load $1 #0\nloop:\nnop\ninc $1\nload $31 @loop\njmp $31",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 0, 0},
+				{byte(code.OpLoad), 30, 1, 0},
+				{byte(code.OpAdd), 1, 30, 1},
+				{byte(code.OpLoad), 31, 4, 0},
+				{byte(code.OpJmp), 31, 0, 0},
+			},
+		},
+		{
+			// No folding when a jump target isn't a label, it could land mid-block
+			"load $1 #4\nload $2 #1\nadd $2 $2 $3\neq $1 $2\njmpf $1\nnop\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 1, 4, 0},
+				{byte(code.OpLoad), 2, 1, 0},
+				{byte(code.OpAdd), 2, 2, 3},
+				{byte(code.OpEq), 1, 2, 0},
+				{byte(code.OpJmpf), 1, 0, 0},
+				{byte(code.OpNop), 0, 0, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			// The label is loaded in another block, on every path to the jump
+			"load $31 @end\nload $1 #1\nagain:\nnop\nsub $1 #1 $1\njz $31\njmp @again\nend:\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 31, 24, 0},
+				{byte(code.OpLoad), 1, 1, 0},
+				{byte(code.OpSubi), 1, 1, 0},
+				{byte(code.OpJz), 31, 0, 0},
+				{byte(code.OpLoad), 30, 8, 0},
+				{byte(code.OpJmp), 30, 0, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			// So does jumping to a literal offset
+			"load $31 #12\njmp $31\nnop\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 31, 12, 0},
+				{byte(code.OpJmp), 31, 0, 0},
+				{byte(code.OpNop), 0, 0, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+		{
+			"load $31 #12\nloop:\nnop\njmp $31\nhlt",
+			[]code.Instructions{
+				{byte(code.OpLoad), 31, 12, 0},
+				{byte(code.OpNop), 0, 0, 0},
+				{byte(code.OpJmp), 31, 0, 0},
+				{byte(code.OpHlt), 0, 0, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := NewWithOptions(Options{ScratchRegister: DefaultScratchRegister, Optimize: true})
+		if err := compiler.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		expected := concatInstructions(tt.expectedInstructions)
+		actual := compiler.Bytecode().Instructions
+		if actual.String() != expected.String() {
+			t.Errorf("wrong instructions for %q.\nwant=%q\ngot =%q",
+				tt.input, expected, actual)
+		}
+	}
+}
+
+func TestOptimizeKeepsLayout(t *testing.T) {
+	// Each jumps through something other than a label loaded as it is, so
+	// removing the nop would change where it lands
+	tests := []string{
+		// A literal offset that's read before the jump
+		"load $1 #20\neq $1 $1\nnop\nlbl:\njmp $1\nload $5 #1\nload $6 #42\nhlt",
+		// A literal offset that goes through the stack
+		"load $1 #20\npush $1\nnop\npop $2\njmp $2\nload $5 #1\nload $6 #42\nhlt",
+		// A label with an offset added, like a jump table
+		"load $1 @table\nload $2 #8\nadd $1 $2 $1\njmp $1\nnop\ntable:\nhlt\nhlt\nload $6 #42\nhlt",
+		// A label through memory
+		"load $1 @end\nload $2 #0\nsw $1 $2\nnop\nlw $2 $3\njmp $3\nend:\nhlt",
+		// A literal on one path and a label on the other
+		"load $1 @end\neq $1 $1\nload $2 @other\njmpe $2\nload $1 #28\nother:\nnop\njmp $1\nend:\nhlt",
+		// A literal pushed for a ret to jump to
+		"load $1 #16\npush $1\nnop\nret\nhlt",
+		// A literal left in a register by a call
+		"call @f\njmp $1\nnop\nhlt\nf:\nload $1 #12\nret",
+	}
+
+	for _, input := range tests {
+		compiler := NewWithOptions(Options{ScratchRegister: DefaultScratchRegister, Optimize: true})
+		if err := compiler.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		stats := compiler.OptimizeStats()
+		if stats.After != stats.Before {
+			t.Errorf("instructions removed from %q, want the layout kept. before=%d, after=%d",
+				input, stats.Before, stats.After)
+		}
+	}
+}
+
+func TestOptimizeMovesLabels(t *testing.T) {
+	input := `.data
+ptr: .word @end
+.code
+.entry @start
+nop
+start:
+inc $1
+nop
+end:
+hlt`
+
+	compiler := NewWithOptions(Options{ScratchRegister: DefaultScratchRegister, Optimize: true})
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	stats := compiler.OptimizeStats()
+	if stats.Before != 5 || stats.After != 3 {
+		t.Errorf("wrong stats. want=5 before, 3 after, got=%+v", stats)
+	}
+
+	bytecode := compiler.Bytecode()
+	if bytecode.Entry != 0 {
+		t.Errorf("wrong entry. want=0, got=%d", bytecode.Entry)
+	}
+	if bytecode.Data[0] != 8 {
+		t.Errorf("wrong .word @end. want=8, got=%d", bytecode.Data[0])
+	}
+	expansion := Expansion{Offset: 0, Length: 8, Source: "inc $1"}
+	if len(bytecode.Expansions) != 1 || bytecode.Expansions[0] != expansion {
+		t.Errorf("wrong expansions. want=%+v, got=%+v", expansion, bytecode.Expansions)
+	}
+
+	expected := []SourceLine{
+		{Offset: 0, Length: 8, Line: 7},
+		{Offset: 8, Length: 4, Line: 10},
+	}
+	if len(bytecode.SourceMap) != len(expected) {
+		t.Fatalf("wrong source map. want=%+v, got=%+v", expected, bytecode.SourceMap)
+	}
+	for i, line := range expected {
+		if bytecode.SourceMap[i] != line {
+			t.Errorf("sourceMap[%d] wrong. want=%+v, got=%+v", i, line, bytecode.SourceMap[i])
+		}
+	}
+}
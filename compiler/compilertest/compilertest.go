@@ -0,0 +1,26 @@
+// Helpers for tests in packages that work on compiled programs
+package compilertest
+
+import (
+	"simpsel/compiler"
+	"simpsel/lexer"
+	"simpsel/parser"
+	"testing"
+)
+
+// Assembles input with the default options, failing the test if it doesn't parse or compile
+func Compile(t *testing.T, input string) *compiler.Compiler {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return comp
+}
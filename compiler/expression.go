@@ -0,0 +1,190 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"math"
+	"simpsel/ast"
+	"simpsel/diag"
+	"simpsel/token"
+)
+
+// The range of values a field of an instruction or data directive can hold
+type field struct {
+	name     string
+	min, max int64
+}
+
+var (
+	loadField  = field{"a load immediate", math.MinInt32, math.MaxUint32}
+	luiField   = field{"a lui immediate", 0, math.MaxUint16}
+	immField   = field{"an immediate operand", 0, math.MaxUint16}
+	byteField  = field{"a byte", math.MinInt8, math.MaxUint8}
+	wordField  = field{"a word", math.MinInt32, math.MaxUint32}
+	spaceField = field{"a .space size", 0, math.MaxUint16}
+
+	// An expression using a label is only worked out once every instruction
+	// has been emitted, too late to split a load in two, so it gets 16 bits
+	shortField = field{"a 16 bit immediate", 0, math.MaxUint16}
+)
+
+func (f field) check(expr ast.Expression, value int64) error {
+	if value < f.min || value > f.max {
+		return diag.Errorf(firstToken(expr), "value %d does not fit in %s, must be between %d and %d",
+			value, f.name, f.min, f.max)
+	}
+	return nil
+}
+
+// Works out a constant expression that doesn't use labels so it can be
+// encoded like a literal. Expressions using labels are returned as they are,
+// to be worked out by patchLabels.
+func (c *Compiler) fold(expr ast.Expression, f field) (ast.Expression, error) {
+	switch expr.(type) {
+	case *ast.IntegerLiteral, *ast.PrefixExpression, *ast.InfixExpression, *ast.CallExpression:
+	default:
+		return expr, nil
+	}
+	if usesLabels(expr) {
+		return expr, nil
+	}
+
+	value, err := c.evaluate(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.check(expr, value); err != nil {
+		return nil, err
+	}
+	return &ast.IntegerLiteral{Token: firstToken(expr), Value: value}, nil
+}
+
+// Works out the value of a constant expression, with labels standing for their offsets
+func (c *Compiler) evaluate(expr ast.Expression) (int64, error) {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral:
+		return expr.Value, nil
+
+	case *ast.LabelReference:
+		sym, ok := c.symbols.Resolve(expr.Name)
+		if !ok {
+			return 0, diag.Errorf(expr.Token, "undefined label %q", expr.Name)
+		}
+		return int64(c.address(sym)), nil
+
+	case *ast.PrefixExpression:
+		right, err := c.evaluate(expr.Right)
+		if err != nil {
+			return 0, err
+		}
+		if right == math.MinInt64 {
+			return 0, diag.Errorf(expr.Token, "constant expression overflows")
+		}
+		return -right, nil
+
+	case *ast.CallExpression:
+		arg, err := c.evaluate(expr.Argument)
+		if err != nil {
+			return 0, err
+		}
+		if expr.Function == "HIGH" {
+			return arg >> 16 & 0xFFFF, nil
+		}
+		return arg & 0xFFFF, nil
+
+	case *ast.InfixExpression:
+		left, err := c.evaluate(expr.Left)
+		if err != nil {
+			return 0, err
+		}
+		right, err := c.evaluate(expr.Right)
+		if err != nil {
+			return 0, err
+		}
+		return evaluateInfix(expr.Token, left, right)
+	}
+
+	return 0, diag.Errorf(firstToken(expr), "%s can't be used in a constant expression", expr.String())
+}
+
+func evaluateInfix(op token.Token, left, right int64) (int64, error) {
+	var result int64
+	overflow := false
+
+	switch op.Type {
+	case token.PLUS:
+		result = left + right
+		overflow = (right > 0 && result < left) || (right < 0 && result > left)
+	case token.MINUS:
+		result = left - right
+		overflow = (right < 0 && result < left) || (right > 0 && result > left)
+	case token.ASTERISK:
+		result = left * right
+		overflow = left != 0 && (result/left != right || (left == -1 && right == math.MinInt64))
+	case token.SLASH, token.PERCENT:
+		if right == 0 {
+			return 0, diag.Errorf(op, "division by zero in constant expression")
+		}
+		if left == math.MinInt64 && right == -1 {
+			return 0, diag.Errorf(op, "constant expression overflows")
+		}
+		if op.Type == token.SLASH {
+			return left / right, nil
+		}
+		return left % right, nil
+	case token.AMPERSAND:
+		result = left & right
+	case token.PIPE:
+		result = left | right
+	case token.LSHIFT, token.RSHIFT:
+		if right < 0 || right > 63 {
+			return 0, diag.Errorf(op, "can't shift by %d, must be between 0 and 63", right)
+		}
+		if op.Type == token.RSHIFT {
+			return left >> uint(right), nil
+		}
+		result = left << uint(right)
+		overflow = result>>uint(right) != left
+	default:
+		return 0, diag.Errorf(op, "unknown operator %s", op.Literal)
+	}
+
+	if overflow {
+		return 0, diag.Errorf(op, "constant expression overflows")
+	}
+	return result, nil
+}
+
+func usesLabels(expr ast.Expression) bool {
+	return len(labelsIn(expr)) > 0
+}
+
+// The token an expression starts with, for pointing diagnostics at it
+func firstToken(expr ast.Expression) token.Token {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral:
+		return expr.Token
+	case *ast.LabelReference:
+		return expr.Token
+	case *ast.RegisterLiteral:
+		return expr.Token
+	case *ast.PrefixExpression:
+		return expr.Token
+	case *ast.InfixExpression:
+		return firstToken(expr.Left)
+	case *ast.CallExpression:
+		return expr.Token
+	}
+	return token.Token{}
+}
+
+// Writes value into the first width bytes of b
+func putValue(b []byte, width int, value int64) {
+	switch width {
+	case 1:
+		b[0] = byte(value)
+	case 2:
+		binary.LittleEndian.PutUint16(b, uint16(value))
+	case 4:
+		binary.LittleEndian.PutUint32(b, uint32(value))
+	}
+}
@@ -0,0 +1,155 @@
+package compiler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"simpsel/ast"
+	"simpsel/code"
+	"simpsel/diag"
+	"strings"
+)
+
+// Data is listed this many bytes to a row
+const listingRowWidth = 8
+
+// An instruction or directive and the bytes it was compiled to
+type mapping struct {
+	node    ast.Instruction
+	section Section
+	offset  int // Offset of the first byte in the section
+	length  int // Number of bytes emitted, 0 for labels and other directives
+}
+
+// Writes a listing of the compiled program: the offset, bytes and source line
+// of every instruction and directive, the value of any labels it uses, and
+// the symbol table. sources holds the text of each file, as from
+// parser.Sources, and is only used to show the original lines.
+func (c *Compiler) WriteListing(w io.Writer, sources diag.Sources) error {
+	out := bufio.NewWriter(w)
+	lines := map[string][]string{}
+
+	fmt.Fprintf(out, "%-4s %-4s  %-23s  %-16s %s\n", "SECT", "OFFS", "BYTES", "LINE", "SOURCE")
+	for i, m := range c.mappings {
+		pos := m.node.Pos()
+		if _, ok := m.node.(*ast.LabelDeclaration); ok && i+1 < len(c.mappings) {
+			// A label shares its row with whatever follows it on the same line
+			if next := c.mappings[i+1].node.Pos(); next.File == pos.File && next.Line == pos.Line {
+				continue
+			}
+		}
+		if _, ok := lines[pos.File]; !ok {
+			lines[pos.File] = strings.Split(sources[pos.File], "\n")
+		}
+		source := m.node.String()
+		if file := lines[pos.File]; pos.Line > 0 && pos.Line <= len(file) {
+			source = strings.TrimSpace(strings.TrimSuffix(file[pos.Line-1], "\r"))
+		}
+		if values := c.labelValues(m.node); values != "" {
+			source += "    ; " + values
+		}
+
+		location := fmt.Sprint(pos.Line)
+		if pos.File != "" {
+			location = fmt.Sprintf("%s:%d", pos.File, pos.Line)
+		}
+
+		if expansion, ok := c.expansionAt(m); ok {
+			// The pseudo-instruction gets a line of its own, followed by what it expanded to
+			writeRow(out, m.section, m.offset, nil, location, source)
+			for offset := expansion.Offset; offset < expansion.Offset+expansion.Length; offset += code.InstructionWidth {
+				ins := c.instructions[offset : offset+code.InstructionWidth]
+				text, err := code.FormatInstruction(ins)
+				if err != nil {
+					return err
+				}
+				writeRow(out, m.section, offset, ins, "", "  + "+text)
+			}
+			continue
+		}
+
+		bytes := c.sectionBytes(m.section)[m.offset : m.offset+m.length]
+		rowWidth := listingRowWidth
+		if m.section == CodeSection {
+			rowWidth = code.InstructionWidth
+		}
+		for start := 0; start == 0 || start < len(bytes); start += rowWidth {
+			end := start + rowWidth
+			if end > len(bytes) {
+				end = len(bytes)
+			}
+			if start > 0 {
+				location, source = "", ""
+			}
+			writeRow(out, m.section, m.offset+start, bytes[start:end], location, source)
+		}
+	}
+
+	fmt.Fprintf(out, "\nSYMBOLS\n")
+	for _, sym := range c.symbols.All() {
+		fmt.Fprintf(out, "%-4s %04d  %s (line %d)\n", sym.Section, sym.Offset, sym.Name, sym.Line)
+	}
+
+	return out.Flush()
+}
+
+func writeRow(out io.Writer, section Section, offset int, bytes []byte, location, source string) {
+	row := fmt.Sprintf("%-4s %04d  %-23s  %-16s %s", section, offset, code.Instructions(bytes), location, source)
+	fmt.Fprintln(out, strings.TrimRight(row, " "))
+}
+
+// The pseudo-instruction expansion m was compiled to, if any
+func (c *Compiler) expansionAt(m mapping) (Expansion, bool) {
+	if m.section != CodeSection || m.length == 0 {
+		return Expansion{}, false
+	}
+	for _, expansion := range c.expansions {
+		if expansion.Offset == m.offset {
+			return expansion, true
+		}
+	}
+	return Expansion{}, false
+}
+
+// Lists the labels used by node with what they resolved to, ie `@end = 44`
+func (c *Compiler) labelValues(node ast.Instruction) string {
+	var operands []ast.Expression
+	switch node := node.(type) {
+	case *ast.AssemblerInstruction:
+		operands = []ast.Expression{node.Operand1, node.Operand2, node.Operand3}
+	case *ast.DataDirective:
+		operands = node.Values
+	case *ast.EntryDirective:
+		operands = []ast.Expression{node.Label}
+	}
+
+	var values []string
+	seen := map[string]bool{}
+	for _, operand := range operands {
+		for _, label := range labelsIn(operand) {
+			if seen[label.Name] {
+				continue
+			}
+			seen[label.Name] = true
+			if sym, ok := c.symbols.Resolve(label.Name); ok {
+				values = append(values, fmt.Sprintf("@%s = %d", label.Name, sym.Offset))
+			}
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+// Every label reference in expr, in order
+func labelsIn(expr ast.Expression) []*ast.LabelReference {
+	switch expr := expr.(type) {
+	case *ast.LabelReference:
+		return []*ast.LabelReference{expr}
+	case *ast.PrefixExpression:
+		return labelsIn(expr.Right)
+	case *ast.InfixExpression:
+		return append(labelsIn(expr.Left), labelsIn(expr.Right)...)
+	case *ast.CallExpression:
+		return labelsIn(expr.Argument)
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"math"
+	"simpsel/ast"
+	"simpsel/code"
+)
+
+// The optimiser runs over the emitted code before the labels are patched, so
+// removing an instruction only has to move the labels after it down and every
+// reference to them comes out right. It looks at one basic block at a time:
+// what's known about the registers is forgotten at each label and after each
+// jump or call. That only holds if every jump lands on a label, so a program
+// whose code can't move is left alone altogether.
+
+// Instruction counts from the optimiser, both 0 if it didn't run
+type OptimizeStats struct {
+	Before, After int
+}
+
+func (c *Compiler) OptimizeStats() OptimizeStats {
+	return c.stats
+}
+
+func (c *Compiler) optimizeCode() {
+	c.stats.Before = len(c.instructions) / code.InstructionWidth
+
+	if c.canMoveCode() {
+		for c.peephole() {
+		}
+	}
+
+	c.stats.After = len(c.instructions) / code.InstructionWidth
+}
+
+// Makes the first improvement it finds, returning false once there are none left
+func (c *Compiler) peephole() bool {
+	leaders := c.leaders()
+	fixed := c.fixedInstructions()
+	known := map[int]int32{}
+
+	for offset := 0; offset < len(c.instructions); offset += code.InstructionWidth {
+		if leaders[offset] {
+			known = map[int]int32{}
+		}
+		op, operands := c.decodeAt(offset)
+
+		if c.redundant(offset, op, operands, known) {
+			c.removeInstruction(offset)
+			return true
+		}
+		if !leaders[offset] && c.jumpsToNext(offset, op, operands) {
+			// A jmp @label or jmpz loaded the target into the scratch register just for this
+			load := offset - code.InstructionWidth
+			pseudo := c.sameExpansion(load, offset)
+			c.removeInstruction(offset)
+			if pseudo {
+				c.removeInstruction(load)
+			}
+			return true
+		}
+
+		dst, value, ok := foldArithmetic(known, op, operands)
+		if ok && !fixed[offset] && value >= 0 && value <= math.MaxUint16 && c.flagsUnused(offset+code.InstructionWidth) {
+			ins := c.instructions[offset:]
+			ins[0] = byte(code.OpLoad)
+			ins[1] = byte(dst)
+			binary.LittleEndian.PutUint16(ins[2:], uint16(value))
+			return true
+		}
+
+		c.track(known, op, operands, fixed[offset])
+	}
+	return false
+}
+
+// Whether the instruction at offset can go without changing what the program does
+func (c *Compiler) redundant(offset int, op code.Opcode, operands []int, known map[int]int32) bool {
+	switch op {
+	case code.OpNop:
+		return true
+	case code.OpAdd:
+		// Adding a register that holds 0 to another and putting it back where it came from
+		a, b, dst := operands[0], operands[1], operands[2]
+		zero := (isZero(known, a) && b == dst) || (isZero(known, b) && a == dst)
+		return zero && c.flagsUnused(offset+code.InstructionWidth)
+	case code.OpLoad:
+		return c.overwritten(offset+code.InstructionWidth, operands[0])
+	}
+	return false
+}
+
+// Whether reg is written before anything reads it, running straight on from offset
+func (c *Compiler) overwritten(offset, reg int) bool {
+	for ; offset < len(c.instructions); offset += code.InstructionWidth {
+		op, operands := c.decodeAt(offset)
+		reads, writes := code.RegisterEffects(op, operands)
+		if contains(reads, reg) {
+			return false
+		}
+		if contains(writes, reg) {
+			return true
+		}
+		if endsBlock(op) {
+			return false
+		}
+	}
+	return false
+}
+
+// Whether the Z, N, C and V flags are set again before anything tests them,
+// running straight on from offset. Arithmetic sets them and a load doesn't, so
+// an add can only be removed or folded if nothing needs its flags.
+func (c *Compiler) flagsUnused(offset int) bool {
+	for ; offset < len(c.instructions); offset += code.InstructionWidth {
+		op := code.Opcode(c.instructions[offset])
+		if code.ReadsFlags(op) {
+			return false
+		}
+		// Once the program stops nothing can test them
+		if code.SetsFlags(op) || op == code.OpHlt || op == code.OpIgl {
+			return true
+		}
+		if endsBlock(op) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the instruction at offset is a jmp or a conditional jump to the
+// instruction after it, through a register loaded with a label just before
+func (c *Compiler) jumpsToNext(offset int, op code.Opcode, operands []int) bool {
+	if (op != code.OpJmp && !code.IsBranch(op)) || offset == 0 {
+		return false
+	}
+
+	load := offset - code.InstructionWidth
+	prevOp, prevOperands := c.decodeAt(load)
+	if prevOp != code.OpLoad || prevOperands[0] != operands[0] {
+		return false
+	}
+	f, ok := c.fixupAt(load)
+	if !ok {
+		return false
+	}
+	label, ok := f.expr.(*ast.LabelReference)
+	if !ok {
+		return false
+	}
+	sym, ok := c.symbols.Resolve(label.Name)
+	return ok && sym.Section == CodeSection && sym.Offset == offset+code.InstructionWidth
+}
+
+// Whether the instructions at a and b came from the same pseudo-instruction
+func (c *Compiler) sameExpansion(a, b int) bool {
+	for _, expansion := range c.expansions {
+		end := expansion.Offset + expansion.Length
+		if a >= expansion.Offset && a < end && b >= expansion.Offset && b < end {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the optimiser can touch the code. Only label references are fixed up
+// when code moves, so every register a jump or call goes through has to hold
+// a label, loaded as it is, on every path that gets there. A literal offset,
+// arithmetic on a label or an offset that went through the stack or memory
+// would still point at the old layout, as would a jmpf or jmpb. A push can
+// also feed a ret, so what's pushed has to be a label too if there is one.
+// The same jumps could land in the middle of a block, where what peephole
+// knows about the registers no longer holds, so nothing is folded either.
+func (c *Compiler) canMoveCode() bool {
+	count := len(c.instructions) / code.InstructionWidth
+	var targets, returns []int
+	hasRet := false
+	for offset := 0; offset < len(c.instructions); offset += code.InstructionWidth {
+		switch code.Opcode(c.instructions[offset]) {
+		case code.OpJmpf, code.OpJmpb:
+			return false
+		case code.OpCall, code.OpCalli:
+			returns = append(returns, offset+code.InstructionWidth)
+		case code.OpRet:
+			hasRet = true
+		}
+	}
+	for _, sym := range c.symbols.All() {
+		if sym.Section == CodeSection && sym.Offset < len(c.instructions) {
+			targets = append(targets, sym.Offset)
+		}
+	}
+
+	in := make([]labelRegisters, count)
+	entry := c.entryOffset()
+	if entry >= len(c.instructions) {
+		return true
+	}
+	in[entry/code.InstructionWidth] = labelRegisters{}
+	work := []int{entry}
+	flow := func(offset int, state labelRegisters) {
+		if offset < 0 || offset >= len(c.instructions) {
+			return
+		}
+		i := offset / code.InstructionWidth
+		if merged, changed := state.meet(in[i]); changed {
+			in[i] = merged
+			work = append(work, offset)
+		}
+	}
+
+	for len(work) > 0 {
+		offset := work[0]
+		work = work[1:]
+		op, operands := c.decodeAt(offset)
+		before := in[offset/code.InstructionWidth]
+
+		if code.JumpsToRegister(op) {
+			if _, ok := before[operands[0]]; !ok {
+				return false
+			}
+		}
+		if op == code.OpPush && hasRet {
+			if _, ok := before[operands[0]]; !ok {
+				return false
+			}
+		}
+
+		after := before.copy()
+		_, writes := code.RegisterEffects(op, operands)
+		for _, reg := range writes {
+			delete(after, reg)
+		}
+		if label, ok := c.loadedLabel(offset, op); ok {
+			after[operands[0]] = label
+		}
+
+		// Where control goes next. A jump through a register that could hold
+		// one of several labels might land on any of them.
+		jumpTo := func(offset int) {
+			if offset >= 0 {
+				flow(offset, before)
+				return
+			}
+			for _, target := range targets {
+				flow(target, before)
+			}
+		}
+		switch {
+		case op == code.OpHlt || op == code.OpIgl:
+		case op == code.OpRet:
+			// Back to the instruction after any call
+			for _, next := range returns {
+				flow(next, after)
+			}
+		case op == code.OpCalli:
+			target := -1
+			if f, ok := c.fixupAt(offset); ok {
+				target = c.labelOffset(f.expr)
+			}
+			jumpTo(target)
+		case code.JumpsToRegister(op):
+			jumpTo(before[operands[0]])
+			if code.IsBranch(op) {
+				flow(offset+code.InstructionWidth, after)
+			}
+		default:
+			flow(offset+code.InstructionWidth, after)
+		}
+	}
+	return true
+}
+
+// The offset the program starts at. An entry label that isn't in the code is
+// reported by patchLabels.
+func (c *Compiler) entryOffset() int {
+	if c.entry != nil {
+		if sym, ok := c.symbols.Resolve(c.entry.Name); ok && sym.Section == CodeSection {
+			return sym.Offset
+		}
+	}
+	return 0
+}
+
+// The registers known to hold a label loaded as it is, by the label's offset,
+// or -1 if it could be one of several. nil means no path has got there yet.
+type labelRegisters map[int]int
+
+func (l labelRegisters) copy() labelRegisters {
+	c := labelRegisters{}
+	for reg, label := range l {
+		c[reg] = label
+	}
+	return c
+}
+
+// Combines l, arriving from another path, with old. A register only stays
+// a label if it's one on both paths.
+func (l labelRegisters) meet(old labelRegisters) (labelRegisters, bool) {
+	if old == nil {
+		return l.copy(), true
+	}
+	changed := false
+	for reg, label := range old {
+		other, ok := l[reg]
+		switch {
+		case !ok:
+			delete(old, reg)
+			changed = true
+		case other != label && label != -1:
+			old[reg] = -1
+			changed = true
+		}
+	}
+	return old, changed
+}
+
+// The offset of the code label the instruction at offset loads as it is, ie
+// `load $1 @loop` but not `load $1 (@loop + 4)`
+func (c *Compiler) loadedLabel(offset int, op code.Opcode) (int, bool) {
+	if op != code.OpLoad {
+		return 0, false
+	}
+	f, ok := c.fixupAt(offset)
+	if !ok {
+		return 0, false
+	}
+	label := c.labelOffset(f.expr)
+	return label, label >= 0
+}
+
+// The offset of the code label expr refers to, -1 if it isn't just a code label
+func (c *Compiler) labelOffset(expr ast.Expression) int {
+	label, ok := expr.(*ast.LabelReference)
+	if !ok {
+		return -1
+	}
+	sym, ok := c.symbols.Resolve(label.Name)
+	if !ok || sym.Section != CodeSection {
+		return -1
+	}
+	return sym.Offset
+}
+
+// Updates known, the registers holding a constant, for an instruction. One
+// with a fixup loads a label, which isn't a constant yet since code can still move.
+func (c *Compiler) track(known map[int]int32, op code.Opcode, operands []int, fixed bool) {
+	switch op {
+	case code.OpLoad:
+		if !fixed {
+			known[operands[0]] = int32(operands[1])
+			return
+		}
+	case code.OpLui:
+		if value, ok := known[operands[0]]; ok && !fixed {
+			known[operands[0]] = int32(uint32(operands[1])<<16 | uint32(value)&0xFFFF)
+			return
+		}
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpAddi, code.OpSubi, code.OpMuli:
+		if dst, value, ok := foldArithmetic(known, op, operands); ok && !fixed {
+			known[dst] = value
+			return
+		}
+	case code.OpCall, code.OpCalli:
+		// The callee can change any register
+		for reg := range known {
+			delete(known, reg)
+		}
+		return
+	}
+
+	_, writes := code.RegisterEffects(op, operands)
+	for _, reg := range writes {
+		delete(known, reg)
+	}
+}
+
+// Works out an add, sub or mul of two registers holding constants, or of a
+// register holding one and an immediate, returning the register it goes in.
+// div isn't folded since it also sets the remainder.
+func foldArithmetic(known map[int]int32, op code.Opcode, operands []int) (int, int32, bool) {
+	var dst int
+	var a, b int32
+	var aok, bok bool
+	switch op {
+	case code.OpAdd, code.OpSub, code.OpMul:
+		a, aok = known[operands[0]]
+		b, bok = known[operands[1]]
+		dst = operands[2]
+	case code.OpAddi, code.OpSubi, code.OpMuli:
+		a, aok = known[operands[0]]
+		b, bok = int32(operands[1]), true
+		dst = operands[0]
+	}
+	if !aok || !bok {
+		return 0, 0, false
+	}
+
+	switch op {
+	case code.OpAdd, code.OpAddi:
+		return dst, a + b, true
+	case code.OpSub, code.OpSubi:
+		return dst, a - b, true
+	}
+	return dst, a * b, true
+}
+
+// Offsets of the instructions that start a basic block
+func (c *Compiler) leaders() map[int]bool {
+	leaders := map[int]bool{0: true}
+	for _, sym := range c.symbols.All() {
+		if sym.Section == CodeSection {
+			leaders[sym.Offset] = true
+		}
+	}
+	for offset := 0; offset < len(c.instructions); offset += code.InstructionWidth {
+		if endsBlock(code.Opcode(c.instructions[offset])) {
+			leaders[offset+code.InstructionWidth] = true
+		}
+	}
+	return leaders
+}
+
+// Whether op is the last instruction of its basic block
+func endsBlock(op code.Opcode) bool {
+	return code.IsTerminator(op) || code.IsBranch(op) || op == code.OpCall || op == code.OpCalli
+}
+
+// Takes the instruction at offset out of the code, moving everything after it
+// down along with the labels, fixups and source mappings
+func (c *Compiler) removeInstruction(offset int) {
+	end := offset + code.InstructionWidth
+	c.instructions = append(c.instructions[:offset], c.instructions[end:]...)
+
+	fixups := c.fixups[:0]
+	for _, f := range c.fixups {
+		if f.section == CodeSection {
+			if f.position >= offset && f.position < end {
+				continue
+			}
+			if f.position >= end {
+				f.position -= code.InstructionWidth
+			}
+		}
+		fixups = append(fixups, f)
+	}
+	c.fixups = fixups
+
+	c.symbols.shift(CodeSection, offset, -code.InstructionWidth)
+	for i := range c.mappings {
+		if c.mappings[i].section == CodeSection {
+			shrinkRun(&c.mappings[i].offset, &c.mappings[i].length, offset)
+		}
+	}
+	expansions := c.expansions[:0]
+	for _, expansion := range c.expansions {
+		shrinkRun(&expansion.Offset, &expansion.Length, offset)
+		// A pseudo-instruction optimised away completely
+		if expansion.Length > 0 {
+			expansions = append(expansions, expansion)
+		}
+	}
+	c.expansions = expansions
+}
+
+// Adjusts a run of code for the instruction at offset being removed
+func shrinkRun(start, length *int, offset int) {
+	switch {
+	case *start > offset:
+		*start -= code.InstructionWidth
+	case offset < *start+*length:
+		*length -= code.InstructionWidth
+	}
+}
+
+// Offsets of the instructions with a fixup
+func (c *Compiler) fixedInstructions() map[int]bool {
+	fixed := map[int]bool{}
+	for _, f := range c.fixups {
+		if f.section == CodeSection {
+			fixed[f.position-f.position%code.InstructionWidth] = true
+		}
+	}
+	return fixed
+}
+
+// The fixup for an operand of the instruction at offset, if it has one
+func (c *Compiler) fixupAt(offset int) (fixup, bool) {
+	for _, f := range c.fixups {
+		if f.section == CodeSection && f.position >= offset && f.position < offset+code.InstructionWidth {
+			return f, true
+		}
+	}
+	return fixup{}, false
+}
+
+func (c *Compiler) decodeAt(offset int) (code.Opcode, []int) {
+	op := code.Opcode(c.instructions[offset])
+	def, err := code.Lookup(byte(op))
+	if err != nil {
+		return op, nil
+	}
+	return op, code.ReadOperands(def, c.instructions[offset+1:])
+}
+
+func isZero(known map[int]int32, reg int) bool {
+	value, ok := known[reg]
+	return ok && value == 0
+}
+
+func contains(regs []int, reg int) bool {
+	for _, r := range regs {
+		if r == reg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package compiler
+
+import (
+	"simpsel/ast"
+	"simpsel/code"
+	"simpsel/diag"
+	"simpsel/token"
+	"strconv"
+	"strings"
+)
+
+// The register pseudo-instructions use for intermediate values unless told otherwise
+const DefaultScratchRegister = 30
+
+// A run of instructions emitted for one pseudo-instruction
+type Expansion struct {
+	Offset int    // Code offset of the first instruction
+	Length int    // Length of the run in bytes
+	Source string // The pseudo-instruction as written, ie `inc $1`
+}
+
+// Whether node is a pseudo-instruction, which has no opcode of its own
+func isPseudo(node *ast.AssemblerInstruction) bool {
+	switch node.Opcode.Type {
+	case token.MOV, token.INC, token.DEC, token.CLR, token.JMPZ:
+		return true
+	case token.JMP:
+		_, ok := node.Operand1.(*ast.LabelReference)
+		return ok
+	}
+	return false
+}
+
+// Lowers a pseudo-instruction to real ones, using the scratch register for
+// any value it needs on the way
+func (c *Compiler) emitPseudo(node *ast.AssemblerInstruction) error {
+	if node.Opcode.Type != token.CLR {
+		for _, operand := range []ast.Expression{node.Operand1, node.Operand2} {
+			if reg, ok := operand.(*ast.RegisterLiteral); ok && reg.Value == c.scratch {
+				return diag.Errorf(reg.Token, "%s can't use $%d, it's the scratch register",
+					node.Opcode.Literal, c.scratch)
+			}
+		}
+	}
+
+	start := len(c.instructions)
+	scratch := &ast.RegisterLiteral{
+		Token: token.Token{Type: token.REGISTER, Literal: strconv.Itoa(int(c.scratch))},
+		Value: c.scratch,
+	}
+	zero := &ast.IntegerLiteral{Token: node.Opcode, Value: 0}
+	one := &ast.IntegerLiteral{Token: node.Opcode, Value: 1}
+
+	switch node.Opcode.Type {
+	case token.MOV:
+		// mov $a $b is $a = $b + 0
+		c.emit(code.OpLoad, scratch, zero)
+		c.emit(code.OpAdd, node.Operand2, scratch, node.Operand1)
+	case token.INC:
+		c.emit(code.OpLoad, scratch, one)
+		c.emit(code.OpAdd, node.Operand1, scratch, node.Operand1)
+	case token.DEC:
+		c.emit(code.OpLoad, scratch, one)
+		c.emit(code.OpSub, node.Operand1, scratch, node.Operand1)
+	case token.CLR:
+		c.emit(code.OpLoad, node.Operand1, zero)
+	case token.JMPZ:
+		c.emit(code.OpLoad, scratch, zero)
+		c.emit(code.OpEq, node.Operand1, scratch)
+		c.emit(code.OpLoad, scratch, node.Operand2)
+		c.emit(code.OpJmpe, scratch)
+	case token.JMP:
+		c.emit(code.OpLoad, scratch, node.Operand1)
+		c.emit(code.OpJmp, scratch)
+	}
+
+	c.expansions = append(c.expansions, Expansion{
+		Offset: start,
+		Length: len(c.instructions) - start,
+		Source: strings.TrimSuffix(node.String(), ";"),
+	})
+	return nil
+}
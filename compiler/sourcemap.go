@@ -0,0 +1,48 @@
+package compiler
+
+import (
+	"simpsel/ast"
+	"sort"
+)
+
+// Where a run of instructions came from in the source
+type SourceLine struct {
+	Offset int    // Code offset of the first instruction
+	Length int    // Length of the run in bytes
+	File   string // Empty for source that didn't come from a file
+	Line   int
+}
+
+// The code mappings as a source map, in offset order
+func (c *Compiler) sourceMap() []SourceLine {
+	var lines []SourceLine
+	for _, m := range c.mappings {
+		if m.section != CodeSection || m.length == 0 {
+			continue
+		}
+		pos := m.node.Pos()
+		lines = append(lines, SourceLine{Offset: m.offset, Length: m.length, File: pos.File, Line: pos.Line})
+	}
+	return lines
+}
+
+// Finds the source line the instruction at offset was assembled from
+func Locate(sourceMap []SourceLine, offset int) (SourceLine, bool) {
+	i := sort.Search(len(sourceMap), func(i int) bool {
+		return sourceMap[i].Offset+sourceMap[i].Length > offset
+	})
+	if i == len(sourceMap) || sourceMap[i].Offset > offset {
+		return SourceLine{}, false
+	}
+	return sourceMap[i], true
+}
+
+// The instruction the code at offset was compiled from
+func (c *Compiler) NodeAt(offset int) (ast.Instruction, bool) {
+	for _, m := range c.mappings {
+		if m.section == CodeSection && offset >= m.offset && offset < m.offset+m.length {
+			return m.node, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,66 @@
+package compiler
+
+import "sort"
+
+type Section string
+
+const (
+	CodeSection Section = "CODE"
+	DataSection Section = "DATA"
+)
+
+type Symbol struct {
+	Name    string
+	Section Section
+	Offset  int // Byte offset into the symbol's section
+	Line    int // Source line the symbol was defined on
+}
+
+type SymbolTable struct {
+	store map[string]Symbol
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{store: make(map[string]Symbol)}
+}
+
+func (s *SymbolTable) Define(name string, section Section, offset, line int) Symbol {
+	symbol := Symbol{Name: name, Section: section, Offset: offset, Line: line}
+	s.store[name] = symbol
+	return symbol
+}
+
+// Every symbol, ordered by section and offset
+func (s *SymbolTable) All() []Symbol {
+	symbols := make([]Symbol, 0, len(s.store))
+	for _, symbol := range s.store {
+		symbols = append(symbols, symbol)
+	}
+
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Section != symbols[j].Section {
+			return symbols[i].Section < symbols[j].Section
+		}
+		if symbols[i].Offset != symbols[j].Offset {
+			return symbols[i].Offset < symbols[j].Offset
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+
+	return symbols
+}
+
+// Moves the symbols in section that are past offset by delta, for when code is removed
+func (s *SymbolTable) shift(section Section, offset, delta int) {
+	for name, symbol := range s.store {
+		if symbol.Section == section && symbol.Offset > offset {
+			symbol.Offset += delta
+			s.store[name] = symbol
+		}
+	}
+}
+
+func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
+	symbol, ok := s.store[name]
+	return symbol, ok
+}
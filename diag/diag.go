@@ -0,0 +1,141 @@
+// Package diag describes problems found in simpsel source and renders them
+// with the offending line and a caret underneath.
+package diag
+
+import (
+	"fmt"
+	"io"
+	"simpsel/token"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+	Note
+)
+
+var severityNames = map[Severity]string{
+	Error:   "error",
+	Warning: "warning",
+	Note:    "note",
+}
+
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// A range of source, End is exclusive
+type Span struct {
+	Start token.Position
+	End   token.Position
+}
+
+func SpanOf(tok token.Token) Span {
+	return Span{Start: tok.Pos(), End: tok.End()}
+}
+
+type Diagnostic struct {
+	Severity Severity
+	Span     Span
+	Message  string
+	Notes    []*Diagnostic // Extra locations, like the macro call a token came from
+}
+
+func Errorf(tok token.Token, format string, a ...interface{}) *Diagnostic {
+	return newDiagnostic(Error, tok, fmt.Sprintf(format, a...))
+}
+
+func Warningf(tok token.Token, format string, a ...interface{}) *Diagnostic {
+	return newDiagnostic(Warning, tok, fmt.Sprintf(format, a...))
+}
+
+// Tokens that came out of a macro point at the macro body, so each call they
+// were expanded from gets a note, innermost first
+func newDiagnostic(severity Severity, tok token.Token, message string) *Diagnostic {
+	d := &Diagnostic{Severity: severity, Span: SpanOf(tok), Message: message}
+	for call := tok.From; call != nil; call = call.From {
+		d.Notes = append(d.Notes, &Diagnostic{
+			Severity: Note,
+			Span:     SpanOf(*call),
+			Message:  fmt.Sprintf("in expansion of macro %q", call.Literal),
+		})
+	}
+	return d
+}
+
+// Diagnostics are errors so the compiler can return them directly
+func (d *Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %s: %s", d.Span.Start, d.Severity, d.Message)
+}
+
+// The text of every file that went into a program, by name. Source that
+// didn't come from a file is stored under "".
+type Sources map[string]string
+
+// Writes the diagnostic followed by its source line with the span underlined,
+// then does the same for each of its notes
+func Render(out io.Writer, sources Sources, d *Diagnostic) {
+	renderOne(out, sources, d)
+	for _, note := range d.Notes {
+		Render(out, sources, note)
+	}
+}
+
+func renderOne(out io.Writer, sources Sources, d *Diagnostic) {
+	fmt.Fprintf(out, "%s\n", d)
+
+	source, ok := sources[d.Span.Start.File]
+	if !ok {
+		return
+	}
+	line, ok := sourceLine(source, d.Span.Start)
+	if !ok {
+		return
+	}
+
+	width := 1
+	if d.Span.End.Line == d.Span.Start.Line && d.Span.End.Column > d.Span.Start.Column {
+		width = d.Span.End.Column - d.Span.Start.Column
+	}
+
+	// Keep tabs so the caret lines up however wide the terminal draws them
+	var pad strings.Builder
+	for i := 0; i < d.Span.Start.Column-1 && i < len(line); i++ {
+		if line[i] == '\t' {
+			pad.WriteByte('\t')
+		} else {
+			pad.WriteByte(' ')
+		}
+	}
+
+	fmt.Fprintf(out, "    %s\n    %s^%s\n", line, pad.String(), strings.Repeat("~", width-1))
+}
+
+func RenderAll(out io.Writer, sources Sources, diagnostics []*Diagnostic) {
+	for _, d := range diagnostics {
+		Render(out, sources, d)
+	}
+}
+
+// The full line of source that pos is on
+func sourceLine(source string, pos token.Position) (string, bool) {
+	if pos.Offset < 0 || pos.Offset > len(source) || pos.Line < 1 {
+		return "", false
+	}
+
+	start := strings.LastIndexByte(source[:pos.Offset], '\n') + 1
+	end := strings.IndexByte(source[pos.Offset:], '\n')
+	if end < 0 {
+		end = len(source)
+	} else {
+		end += pos.Offset
+	}
+
+	return strings.TrimRight(source[start:end], "\r"), true
+}
@@ -0,0 +1,52 @@
+package diag
+
+import (
+	"bytes"
+	"simpsel/token"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	source := "load $1 #1\n\tload #1 $2\nhlt"
+	tok := token.Token{Type: token.INT, Literal: "1", Line: 2, Column: 7, Offset: 17, Length: 2}
+
+	var out bytes.Buffer
+	Render(&out, Sources{"": source}, Errorf(tok, "expected next token to be %s", token.REGISTER))
+
+	expected := "2:7: error: expected next token to be REGISTER\n" +
+		"    \tload #1 $2\n" +
+		"    \t     ^~\n"
+	if out.String() != expected {
+		t.Errorf("wrong rendering.\nwant=%q\ngot =%q", expected, out.String())
+	}
+}
+
+func TestRenderWithoutSource(t *testing.T) {
+	tok := token.Token{Line: 9, Column: 1, Offset: 400, Length: 1}
+
+	var out bytes.Buffer
+	Render(&out, Sources{"": "hlt"}, Warningf(tok, "unreachable"))
+
+	if out.String() != "9:1: warning: unreachable\n" {
+		t.Errorf("wrong rendering. got=%q", out.String())
+	}
+}
+
+func TestRenderNotes(t *testing.T) {
+	source := ".macro seta r\n  load r #1\n.endm\nseta #2"
+	call := token.Token{Type: token.IDENT, Literal: "seta", Line: 4, Column: 1, Offset: 32, Length: 4}
+	tok := token.Token{Type: token.INT, Literal: "2", Line: 2, Column: 8, Offset: 21, Length: 1, From: &call}
+
+	var out bytes.Buffer
+	Render(&out, Sources{"": source}, Errorf(tok, "expected next token to be %s", token.REGISTER))
+
+	expected := "2:8: error: expected next token to be REGISTER\n" +
+		"      load r #1\n" +
+		"           ^\n" +
+		"4:1: note: in expansion of macro \"seta\"\n" +
+		"    seta #2\n" +
+		"    ^~~~\n"
+	if out.String() != expected {
+		t.Errorf("wrong rendering.\nwant=%q\ngot =%q", expected, out.String())
+	}
+}
@@ -10,64 +10,167 @@ type Lexer struct {
 	position     int    // Current position in input (current char)
 	readPosition int    // Current reading position in input (after current char)
 	ch           byte   // Current byte under examination
-	line         int    // The line number
+	line         int    // The line number, starting at 1
+	lineStart    int    // Position of the first char on the current line
+	file         string // Name of the file being lexed, if any
+	depth        int    // How many parentheses deep we are in a constant expression
+	bareValues   bool   // Whether numbers go without a # for the rest of the line, after .equ and .if
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
-func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+// Like New, but every token records that it came from the named file
+func NewFile(file string, input string) *Lexer {
+	l := New(input)
+	l.file = file
+	return l
+}
 
+func (l *Lexer) File() string {
+	return l.file
+}
+
+func (l *Lexer) Input() string {
+	return l.input
+}
+
+func (l *Lexer) NextToken() token.Token {
 	l.skipWhitespace()
 
+	// Reading a token may move past the end of the line, so note where it starts
+	line, column, offset := l.line, l.position-l.lineStart+1, l.position
+
+	tok := l.readToken()
+	tok.Line = line
+	tok.Column = column
+	tok.Offset = offset
+	tok.Length = l.tokenEnd(offset) - offset
+	tok.File = l.file
+	return tok
+}
+
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
+
 	switch l.ch {
 	case '#':
 		l.readChar()
-		if num := l.readNumber(); num != "" {
+		if l.ch == '(' {
+			// #( starts a constant expression, which doesn't need any more #s
+			l.depth++
+			tok = newToken(token.LPAREN, l.ch)
+		} else if isVarTer(l.ch) {
+			return l.readName()
+		} else if num := l.readInteger(); num != "" {
 			tok.Type = token.INT
 			tok.Literal = num
-			tok.Line = l.line
+			return tok
 		} else {
-			tok = newToken(token.ILLEGAL, l.ch, l.line)
+			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	case '$':
 		l.readChar()
 		if num := l.readNumber(); num != "" {
 			tok.Type = token.REGISTER
 			tok.Literal = num
-			tok.Line = l.line
+			return tok
 		} else {
-			tok = newToken(token.ILLEGAL, l.ch, l.line)
+			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	case '.':
 		l.readChar()
 		if isVarTer(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupDirective(strings.ToLower(tok.Literal))
-			tok.Line = l.line
+			l.bareValues = tok.Type == token.EQU || tok.Type == token.IF
 			return tok
 		} else {
-			tok = newToken(token.ILLEGAL, l.ch, l.line)
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '@':
+		l.readChar()
+		if isVarTer(l.ch) {
+			tok.Literal = l.readIdentifier()
+			tok.Type = token.LABEL_REF
+			return tok
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '"':
+		if str, ok := l.readString(); ok {
+			tok.Type = token.STRING
+			tok.Literal = str
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case ',':
+		tok = newToken(token.COMMA, l.ch)
+	case '(':
+		l.depth++
+		tok = newToken(token.LPAREN, l.ch)
+	case ')':
+		if l.depth > 0 {
+			l.depth--
+		}
+		tok = newToken(token.RPAREN, l.ch)
+	case '+':
+		tok = newToken(token.PLUS, l.ch)
+	case '-':
+		if l.bareValues && l.depth == 0 && isDigit(l.peekChar()) {
+			return l.readBareInteger()
+		}
+		tok = newToken(token.MINUS, l.ch)
+	case '*':
+		tok = newToken(token.ASTERISK, l.ch)
+	case '/':
+		tok = newToken(token.SLASH, l.ch)
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
+	case '&':
+		tok = newToken(token.AMPERSAND, l.ch)
+	case '|':
+		tok = newToken(token.PIPE, l.ch)
+	case '<', '>':
+		if l.peekChar() == l.ch {
+			tok.Type = token.LSHIFT
+			if l.ch == '>' {
+				tok.Type = token.RSHIFT
+			}
+			tok.Literal = string([]byte{l.ch, l.ch})
+			l.readChar()
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	case ';':
-		tok = newToken(token.COMMENT, l.ch, l.line)
+		tok = newToken(token.COMMENT, l.ch)
 		l.skipUntilNewline()
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
-		tok.Line = l.line
 	default:
+		// Inside an expression numbers and constant names go without a #
+		if (l.depth > 0 || l.bareValues) && (isDigit(l.ch) || l.ch == '\'') {
+			return l.readBareInteger()
+		}
+		if l.depth > 0 && isVarTer(l.ch) {
+			return l.readName()
+		}
+
 		if isVarTer(l.ch) {
 			tok.Literal = l.readIdentifier()
+			if l.ch == ':' {
+				tok.Type = token.LABEL
+				l.readChar()
+				return tok
+			}
 			tok.Type = token.LookupIdent(strings.ToLower(tok.Literal))
-			tok.Line = l.line
 			return tok
 		} else {
-			tok = newToken(token.ILLEGAL, l.ch, l.line)
+			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
 
@@ -76,18 +179,33 @@ func (l *Lexer) NextToken() token.Token {
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.lineStart = l.readPosition
+		l.depth = 0 // Expressions never run over a line
+		l.bareValues = false
+	}
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
 		l.ch = l.input[l.readPosition]
 	}
-	if l.ch == '\n' {
-		l.line ++
-	}
 	l.position = l.readPosition
 	l.readPosition += 1
 }
 
+// Where the token that started at offset ends, not counting a trailing newline
+func (l *Lexer) tokenEnd(offset int) int {
+	end := l.position
+	if end > len(l.input) {
+		end = len(l.input)
+	}
+	for end > offset && (l.input[end-1] == '\n' || l.input[end-1] == '\r') {
+		end--
+	}
+	return end
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
@@ -104,7 +222,7 @@ func (l *Lexer) peekChar() byte {
 
 func (l *Lexer) readIdentifier() string {
 	position := l.position
-	for isVarTer(l.ch) {
+	for isVarTer(l.ch) || isDigit(l.ch) {
 		l.readChar()
 		if l.ch == '"' || l.ch == 0 {
 			break
@@ -113,6 +231,15 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
+// Reads a constant name, or a function name if it's followed by (
+func (l *Lexer) readName() token.Token {
+	tok := token.Token{Type: token.CONST, Literal: l.readIdentifier()}
+	if l.ch == '(' {
+		tok.Type = token.FUNCTION
+	}
+	return tok
+}
+
 func (l *Lexer) readNumber() string {
 	position := l.position
 	for isDigit(l.ch) {
@@ -121,6 +248,66 @@ func (l *Lexer) readNumber() string {
 	return l.input[position:l.position]
 }
 
+// Reads up to the closing quote, leaving escape sequences for the parser
+func (l *Lexer) readString() (string, bool) {
+	position := l.position + 1
+	for {
+		l.readChar()
+		if l.ch == '\\' {
+			l.readChar()
+			continue
+		}
+		if l.ch == '"' || l.ch == '\n' || l.ch == 0 {
+			break
+		}
+	}
+	return l.input[position:l.position], l.ch == '"'
+}
+
+// Reads an integer literal: an optional minus sign followed by decimal digits,
+// a 0x or 0b prefixed number, or a quoted character like 'A'. The parser works
+// out the value, so anything number-like is read in one piece here.
+func (l *Lexer) readInteger() string {
+	position := l.position
+	if l.ch == '-' {
+		l.readChar()
+	}
+
+	if l.ch == '\'' {
+		for {
+			l.readChar()
+			if l.ch == '\\' {
+				l.readChar()
+				continue
+			}
+			if l.ch == '\'' || l.ch == '\n' || l.ch == 0 {
+				break
+			}
+		}
+		if l.ch != '\'' {
+			return ""
+		}
+		l.readChar()
+		return l.input[position:l.position]
+	}
+
+	if !isDigit(l.ch) {
+		return ""
+	}
+	for isDigit(l.ch) || isVarTer(l.ch) {
+		l.readChar()
+	}
+	return l.input[position:l.position]
+}
+
+// Reads an integer literal written without a #
+func (l *Lexer) readBareInteger() token.Token {
+	if num := l.readInteger(); num != "" {
+		return token.Token{Type: token.INT, Literal: num}
+	}
+	return newToken(token.ILLEGAL, l.ch)
+}
+
 func (l *Lexer) skipUntilNewline() {
 	for l.ch != '\n' && l.ch != 0 {
 		l.readChar()
@@ -135,6 +322,6 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-func newToken(tType token.TokenType, ch byte, line int) token.Token {
-	return token.Token{Type: tType, Literal: string(ch), Line: line}
+func newToken(tType token.TokenType, ch byte) token.Token {
+	return token.Token{Type: tType, Literal: string(ch)}
 }
\ No newline at end of file
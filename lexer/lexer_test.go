@@ -17,7 +17,7 @@ mul $0 $1 $2`
 		{token.LOAD, "load"},
 		{token.REGISTER, "0"},
 		{token.INT, "10"},
-		{token.ILLEGAL, "aold"},
+		{token.IDENT, "aold"},
 		{token.MUL, "mul"},
 		{token.REGISTER, "0"},
 		{token.REGISTER, "1"},
@@ -40,3 +40,228 @@ mul $0 $1 $2`
 		}
 	}
 }
+
+func TestLabels(t *testing.T) {
+	input := `loop1:
+load $31 @loop1
+jmp $31`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedLine    int
+	}{
+		{token.LABEL, "loop1", 1},
+		{token.LOAD, "load", 2},
+		{token.REGISTER, "31", 2},
+		{token.LABEL_REF, "loop1", 2},
+		{token.JMP, "jmp", 3},
+		{token.REGISTER, "31", 3},
+		{token.EOF, "", 3},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - line wrong. expected=%d, got=%d",
+				i, tt.expectedLine, tok.Line)
+		}
+	}
+}
+
+func TestDataDirectives(t *testing.T) {
+	input := `.data
+msg: .asciiz "hi\n"
+.byte #1, #2
+.word @msg
+.space #4`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.DATA, "data"},
+		{token.LABEL, "msg"},
+		{token.ASCIIZ, "asciiz"},
+		{token.STRING, `hi\n`},
+		{token.BYTE, "byte"},
+		{token.INT, "1"},
+		{token.COMMA, ","},
+		{token.INT, "2"},
+		{token.WORD, "word"},
+		{token.LABEL_REF, "msg"},
+		{token.SPACE, "space"},
+		{token.INT, "4"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	input := "load $0 #10 ; comment\r\n  msg: .asciiz \"hi\"\n\tadd"
+
+	tests := []struct {
+		expectedType   token.TokenType
+		expectedLine   int
+		expectedColumn int
+		expectedOffset int
+		expectedLength int
+	}{
+		{token.LOAD, 1, 1, 0, 4},
+		{token.REGISTER, 1, 6, 5, 2},
+		{token.INT, 1, 9, 8, 3},
+		{token.COMMENT, 1, 13, 12, 9},
+		{token.LABEL, 2, 3, 25, 4},
+		{token.ASCIIZ, 2, 8, 30, 7},
+		{token.STRING, 2, 16, 38, 4},
+		{token.ADD, 3, 2, 44, 3},
+		{token.EOF, 3, 5, 47, 0},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		pos := tok.Pos()
+		if pos.Line != tt.expectedLine || pos.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedColumn, pos.Line, pos.Column)
+		}
+
+		if pos.Offset != tt.expectedOffset {
+			t.Fatalf("tests[%d] - offset wrong. expected=%d, got=%d",
+				i, tt.expectedOffset, pos.Offset)
+		}
+
+		if tok.Length != tt.expectedLength {
+			t.Fatalf("tests[%d] - length wrong. expected=%d, got=%d",
+				i, tt.expectedLength, tok.Length)
+		}
+	}
+}
+
+func TestIntegerLiterals(t *testing.T) {
+	input := `#-1 #0xFF,#0b1010 #'A' #'\'' #SIZE_2 #'
+#-`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "-1"},
+		{token.INT, "0xFF"},
+		{token.COMMA, ","},
+		{token.INT, "0b1010"},
+		{token.INT, "'A'"},
+		{token.INT, `'\''`},
+		{token.CONST, "SIZE_2"},
+		{token.ILLEGAL, "\n"},
+		{token.ILLEGAL, "\x00"},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestConstantExpressions(t *testing.T) {
+	input := `#(SIZE*4 + 'a') #HIGH(@end-@start) #(1<<2|3>>1&4/2%1)
+(`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LPAREN, "("},
+		{token.CONST, "SIZE"},
+		{token.ASTERISK, "*"},
+		{token.INT, "4"},
+		{token.PLUS, "+"},
+		{token.INT, "'a'"},
+		{token.RPAREN, ")"},
+		{token.FUNCTION, "HIGH"},
+		{token.LPAREN, "("},
+		{token.LABEL_REF, "end"},
+		{token.MINUS, "-"},
+		{token.LABEL_REF, "start"},
+		{token.RPAREN, ")"},
+		{token.LPAREN, "("},
+		{token.INT, "1"},
+		{token.LSHIFT, "<<"},
+		{token.INT, "2"},
+		{token.PIPE, "|"},
+		{token.INT, "3"},
+		{token.RSHIFT, ">>"},
+		{token.INT, "1"},
+		{token.AMPERSAND, "&"},
+		{token.INT, "4"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.PERCENT, "%"},
+		{token.INT, "1"},
+		{token.RPAREN, ")"},
+		{token.LPAREN, "("},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
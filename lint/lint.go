@@ -0,0 +1,293 @@
+// Package lint looks for likely mistakes in an assembled simpsel program,
+// like reading a register nothing writes or code that can never run.
+package lint
+
+import (
+	"fmt"
+	"simpsel/ast"
+	"simpsel/code"
+	"simpsel/compiler"
+	"simpsel/diag"
+	"simpsel/token"
+	"sort"
+)
+
+// A decoded instruction
+type instruction struct {
+	offset   int
+	op       code.Opcode
+	operands []int
+}
+
+type finding struct {
+	offset int // Code offset of the instruction, to report in program order
+	diag   *diag.Diagnostic
+}
+
+type checker struct {
+	comp     *compiler.Compiler
+	entry    int
+	program  []instruction
+	labels   map[int]bool // Code offsets with a label, where execution can arrive from elsewhere
+	findings []finding
+}
+
+// Checks a compiled program, returning a diagnostic for each problem found in
+// program order. Most are warnings, but one that's certain to fault is an error.
+func Check(comp *compiler.Compiler) ([]*diag.Diagnostic, error) {
+	bytecode := comp.Bytecode()
+	c := &checker{comp: comp, entry: bytecode.Entry, labels: map[int]bool{}}
+
+	ins := bytecode.Instructions
+	for offset := 0; offset+code.InstructionWidth <= len(ins); offset += code.InstructionWidth {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %s", offset, err)
+		}
+		c.program = append(c.program, instruction{
+			offset:   offset,
+			op:       code.Opcode(ins[offset]),
+			operands: code.ReadOperands(def, ins[offset+1:]),
+		})
+	}
+	for _, sym := range bytecode.Symbols {
+		if sym.Section == compiler.CodeSection {
+			c.labels[sym.Offset] = true
+		}
+	}
+
+	c.checkUnwrittenReads()
+	c.checkUnreachable()
+	c.checkJumpTargets()
+	c.checkJmpe()
+	c.checkDivision()
+	c.checkHlt()
+
+	sort.SliceStable(c.findings, func(i, j int) bool {
+		return c.findings[i].offset < c.findings[j].offset
+	})
+	diagnostics := make([]*diag.Diagnostic, len(c.findings))
+	for i, f := range c.findings {
+		diagnostics[i] = f.diag
+	}
+	return diagnostics, nil
+}
+
+// Reports a warning at the instruction at offset, pointing at register reg
+// if the source names it, or at the mnemonic otherwise
+func (c *checker) warn(offset, reg int, format string, a ...interface{}) {
+	d := diag.Warningf(c.tokenAt(offset, reg), format, a...)
+	c.findings = append(c.findings, finding{offset: offset, diag: d})
+}
+
+// Like warn, but for a mistake that's certain to fault if the instruction runs
+func (c *checker) fail(offset, reg int, format string, a ...interface{}) {
+	d := diag.Errorf(c.tokenAt(offset, reg), format, a...)
+	c.findings = append(c.findings, finding{offset: offset, diag: d})
+}
+
+func (c *checker) tokenAt(offset, reg int) token.Token {
+	var tok token.Token
+	node, _ := c.comp.NodeAt(offset)
+	switch node := node.(type) {
+	case *ast.AssemblerInstruction:
+		tok = node.Opcode
+		for _, operand := range []ast.Expression{node.Operand1, node.Operand2, node.Operand3} {
+			if r, ok := operand.(*ast.RegisterLiteral); ok && int(r.Value) == reg {
+				tok = r.Token
+				break
+			}
+		}
+	case ast.Instruction:
+		pos := node.Pos()
+		tok = token.Token{File: pos.File, Line: pos.Line, Column: pos.Column, Offset: pos.Offset, Length: 1}
+	}
+	return tok
+}
+
+// Whether execution can only arrive at ins from the instruction before it
+func (c *checker) fallsThroughOnly(ins instruction) bool {
+	return !c.labels[ins.offset] && ins.offset != c.entry
+}
+
+// Registers start out as 0, so reading one that nothing ever writes is most
+// likely a typo
+func (c *checker) checkUnwrittenReads() {
+	written := map[int]bool{}
+	for _, ins := range c.program {
+		_, writes := code.RegisterEffects(ins.op, ins.operands)
+		for _, reg := range writes {
+			written[reg] = true
+		}
+	}
+
+	reported := map[int]bool{}
+	for _, ins := range c.program {
+		reads, _ := code.RegisterEffects(ins.op, ins.operands)
+		for _, reg := range reads {
+			if !written[reg] && !reported[reg] {
+				reported[reg] = true
+				c.warn(ins.offset, reg, "$%d is read but never written", reg)
+			}
+		}
+	}
+}
+
+// Code straight after a hlt, ret or jump can only run if something jumps to it
+func (c *checker) checkUnreachable() {
+	for i := 0; i+1 < len(c.program); i++ {
+		ins, next := c.program[i], c.program[i+1]
+		if !code.IsTerminator(ins.op) || !c.fallsThroughOnly(next) {
+			continue
+		}
+
+		def, _ := code.Lookup(byte(ins.op))
+		c.warn(next.offset, -1, "unreachable code after %s", def.Name)
+		// One warning for the whole run of dead code
+		for i+1 < len(c.program) && c.fallsThroughOnly(c.program[i+1]) {
+			i++
+		}
+	}
+}
+
+// Jump targets have to be the start of an instruction, so a register used to
+// jump should only ever be loaded with a multiple of 4
+func (c *checker) checkJumpTargets() {
+	targets := map[int]bool{}
+	for _, ins := range c.program {
+		if code.JumpsToRegister(ins.op) || ins.op == code.OpJmpf || ins.op == code.OpJmpb {
+			targets[ins.operands[0]] = true
+		}
+	}
+
+	for i, ins := range c.program {
+		if ins.op != code.OpLoad || !targets[ins.operands[0]] {
+			continue
+		}
+		value := int32(ins.operands[1])
+		if i+1 < len(c.program) {
+			if next := c.program[i+1]; next.op == code.OpLui && next.operands[0] == ins.operands[0] {
+				value = int32(uint32(next.operands[1])<<16 | uint32(ins.operands[1]))
+			}
+		}
+		if value%code.InstructionWidth != 0 {
+			c.warn(ins.offset, -1, "$%d is used to jump but is loaded with %d, which isn't a multiple of %d",
+				ins.operands[0], value, code.InstructionWidth)
+		}
+	}
+}
+
+// jmpe and jmpne test the equal flag set by the last compare, which starts out false
+func (c *checker) checkJmpe() {
+	compares := false
+	for _, ins := range c.program {
+		compares = compares || code.IsCompare(ins.op)
+	}
+
+	for i, ins := range c.program {
+		if ins.op != code.OpJmpe && ins.op != code.OpJmpne {
+			continue
+		}
+		def, _ := code.Lookup(byte(ins.op))
+		if !compares {
+			c.warn(ins.offset, -1, "%s without a compare, the program never sets the flag it tests", def.Name)
+			continue
+		}
+		if c.startsWithoutCompare(i) {
+			c.warn(ins.offset, -1, "%s without a compare before it, the flag is always false here", def.Name)
+		}
+	}
+}
+
+// Whether the program can start running and reach program[i] without passing
+// a compare or a call, which might compare
+func (c *checker) startsWithoutCompare(i int) bool {
+	for ; i >= 0; i-- {
+		ins := c.program[i]
+		if ins.offset == c.entry {
+			return true
+		}
+		if c.labels[ins.offset] || i == 0 {
+			return false
+		}
+		prev := c.program[i-1]
+		if code.IsCompare(prev.op) || prev.op == code.OpCall || prev.op == code.OpCalli || code.IsTerminator(prev.op) {
+			return false
+		}
+	}
+	return false
+}
+
+// Follows the constants loaded into registers through straight line code to
+// find a div by a register that's always 0
+func (c *checker) checkDivision() {
+	known := map[int]int32{}
+
+	for _, ins := range c.program {
+		if c.labels[ins.offset] {
+			known = map[int]int32{}
+		}
+
+		if ins.op == code.OpDiv || ins.op == code.OpMod {
+			if value, ok := known[ins.operands[1]]; ok && value == 0 {
+				c.fail(ins.offset, ins.operands[1], "division by zero, $%d is always 0 here", ins.operands[1])
+			}
+		}
+
+		switch ins.op {
+		case code.OpLoad:
+			known[ins.operands[0]] = int32(ins.operands[1])
+			continue
+		case code.OpLui:
+			if value, ok := known[ins.operands[0]]; ok {
+				known[ins.operands[0]] = int32(uint32(ins.operands[1])<<16 | uint32(value)&0xFFFF)
+				continue
+			}
+		case code.OpAdd, code.OpSub, code.OpMul:
+			a, aok := known[ins.operands[0]]
+			b, bok := known[ins.operands[1]]
+			if aok && bok {
+				known[ins.operands[2]] = fold(ins.op, a, b)
+				continue
+			}
+		case code.OpAddi, code.OpSubi, code.OpMuli:
+			if a, ok := known[ins.operands[0]]; ok {
+				known[ins.operands[0]] = fold(ins.op, a, int32(ins.operands[1]))
+				continue
+			}
+		case code.OpCall, code.OpCalli:
+			known = map[int]int32{}
+			continue
+		}
+
+		_, writes := code.RegisterEffects(ins.op, ins.operands)
+		for _, reg := range writes {
+			delete(known, reg)
+		}
+	}
+}
+
+func fold(op code.Opcode, a, b int32) int32 {
+	switch op {
+	case code.OpAdd, code.OpAddi:
+		return a + b
+	case code.OpSub, code.OpSubi:
+		return a - b
+	}
+	return a * b
+}
+
+// Without a hlt the program runs off the end of its code
+func (c *checker) checkHlt() {
+	if len(c.program) == 0 {
+		return
+	}
+	for _, ins := range c.program {
+		if ins.op == code.OpHlt {
+			return
+		}
+	}
+
+	last := c.program[len(c.program)-1]
+	c.warn(last.offset, -1, "program has no hlt, it runs off the end of its code")
+}
@@ -0,0 +1,103 @@
+package lint
+
+import (
+	"simpsel/compiler/compilertest"
+	"testing"
+)
+
+func check(t *testing.T, input string) []string {
+	t.Helper()
+
+	warnings, err := Check(compilertest.Compile(t, input))
+	if err != nil {
+		t.Fatalf("check error: %s", err)
+	}
+
+	messages := []string{}
+	for _, w := range warnings {
+		messages = append(messages, w.Error())
+	}
+	return messages
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{
+			"load $1 #1\nadd $1 $2 $3\nhlt",
+			[]string{"2:8: warning: $2 is read but never written"},
+		},
+		{
+			"mov $4 $5\nhlt",
+			[]string{"1:8: warning: $5 is read but never written"},
+		},
+		{
+			"hlt\nnop\nnop\nend:\nhlt",
+			[]string{"2:1: warning: unreachable code after hlt"},
+		},
+		{
+			"load $1 @end\njmp $1\nnop\nend:\nhlt",
+			[]string{"3:1: warning: unreachable code after jmp"},
+		},
+		{
+			"load $1 #6\njmp $1\nend:\nhlt",
+			[]string{"1:1: warning: $1 is used to jump but is loaded with 6, which isn't a multiple of 4"},
+		},
+		{
+			"load $1 #8\nload $2 #1\nload $3 #2\nneq $2 $3\njmpe $1\nhlt",
+			[]string{},
+		},
+		{
+			"load $1 #8\njmpe $1\nhlt",
+			[]string{"2:1: warning: jmpe without a compare, the program never sets the flag it tests"},
+		},
+		{
+			"load $1 #8\njmpne $1\nhlt",
+			[]string{"2:1: warning: jmpne without a compare, the program never sets the flag it tests"},
+		},
+		{
+			"load $1 #12\njmpe $1\nloop:\neq $1 $1\nhlt",
+			[]string{"2:1: warning: jmpe without a compare before it, the flag is always false here"},
+		},
+		{
+			"load $1 #8\nclr $2\ndiv $1 $2 $3\nhlt",
+			[]string{"3:8: error: division by zero, $2 is always 0 here"},
+		},
+		{
+			"load $1 #8\nload $2 #3\nload $4 #3\nsub $2 $4 $2\ndiv $1 $2 $3\nhlt",
+			[]string{"5:8: error: division by zero, $2 is always 0 here"},
+		},
+		{
+			"load $1 #8\nload $2 #3\nsubi $2 #3\ndiv $1 $2 $3\nhlt",
+			[]string{"4:8: error: division by zero, $2 is always 0 here"},
+		},
+		{
+			"load $1 #8\nclr $2\nmod $1 $2 $3\nhlt",
+			[]string{"3:8: error: division by zero, $2 is always 0 here"},
+		},
+		{
+			// A label means $2 could come from elsewhere
+			"load $1 #8\nclr $2\nagain:\ndiv $1 $2 $3\nhlt",
+			[]string{},
+		},
+		{
+			"load $1 #1",
+			[]string{"1:1: warning: program has no hlt, it runs off the end of its code"},
+		},
+	}
+
+	for _, tt := range tests {
+		messages := check(t, tt.input)
+		if len(messages) != len(tt.expected) {
+			t.Errorf("wrong warnings for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, messages)
+			continue
+		}
+		for i := range messages {
+			if messages[i] != tt.expected[i] {
+				t.Errorf("wrong warning for %q.\nwant=%q\ngot =%q", tt.input, tt.expected[i], messages[i])
+			}
+		}
+	}
+}
@@ -1,77 +1,454 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/gliderlabs/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"simpsel/cfg"
+	"simpsel/code"
 	"simpsel/compiler"
+	"simpsel/diag"
 	"simpsel/lexer"
+	"simpsel/lint"
+	"simpsel/object"
 	"simpsel/parser"
 	"simpsel/repl"
 	"simpsel/vm"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
 	addr := flag.String("addr", ":2222", "Address to listen on")
 	runSsh := flag.Bool("ssh", false, "Run the ssh server?")
 	file := flag.String("file", "", "File to run")
+	maxSteps := flag.Int("max-steps", 0, "Stop a -file run after this many instructions, 0 for no limit")
+	timeout := flag.Duration("timeout", 0, "Stop a -file run after this long, 0 for no limit")
+	flag.Var(&includePaths, "I", "Directory to search for .include files, can be repeated")
+	flag.Var(defines, "D", "Define a constant as NAME=value, or NAME for 1, can be repeated")
+	flag.Var(&scratch, "scratch", "Register pseudo-instructions may clobber")
+	flag.BoolVar(&optimize, "O", false, "Run the peephole optimiser over the assembled code")
 
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "build":
+		if !buildFile(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	case "check":
+		if !checkFile(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	case "cfg":
+		if !graphFile(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	case "disasm":
+		disassembleFile(flag.Arg(1))
+		return
+	}
+
 	if *file != "" {
-		fi, err := os.Stat(*file)
+		runFile(*file, *maxSteps, *timeout)
+		return
+	}
+
+	if *runSsh {
+		startSshServer(*addr)
+	} else {
+		repl.Start(os.Stdin, os.Stdout, uint8(scratch))
+	}
+}
+
+// A flag that can be given more than once
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathList) Set(path string) error {
+	*p = append(*p, path)
+	return nil
+}
+
+// Directories searched for .include files
+var includePaths pathList
+
+// Constants given with -D, a bare NAME is defined as 1
+type defineList map[string]int64
+
+func (d defineList) String() string {
+	defs := []string{}
+	for name, value := range d {
+		defs = append(defs, fmt.Sprintf("%s=%d", name, value))
+	}
+	sort.Strings(defs)
+	return strings.Join(defs, ",")
+}
+
+func (d defineList) Set(def string) error {
+	name, value := def, "1"
+	if i := strings.IndexByte(def, '='); i >= 0 {
+		name, value = def[:i], def[i+1:]
+	}
+	if name == "" {
+		return fmt.Errorf("%q has no name", def)
+	}
+
+	v, err := parser.ParseInteger(value)
+	if err != nil {
+		return err
+	}
+	d[name] = v
+	return nil
+}
+
+var defines = defineList{}
+
+// A register given as $30 or 30
+type registerFlag uint8
+
+func (r *registerFlag) String() string {
+	return fmt.Sprintf("$%d", *r)
+}
+
+func (r *registerFlag) Set(reg string) error {
+	n, err := strconv.ParseUint(strings.TrimPrefix(reg, "$"), 10, 8)
+	if err != nil || n > 31 {
+		return fmt.Errorf("%q is not a register between $0 and $31", reg)
+	}
+	*r = registerFlag(n)
+	return nil
+}
+
+// The register pseudo-instructions expand with
+var scratch = registerFlag(compiler.DefaultScratchRegister)
+
+// Whether to optimise source files as they're assembled
+var optimize bool
+
+func readFile(path string) ([]byte, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "Invalid file!")
+		return nil, false
+	}
+	if fi.IsDir() {
+		fmt.Fprintf(os.Stdout, "You can't load a directory!")
+		return nil, false
+	}
+	input, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "An error occured trying to load the file! %s", err)
+		return nil, false
+	}
+	return input, true
+}
+
+// Assembles source, writing a listing to listing unless it's empty
+func assemble(path string, input string, listing string) (*compiler.Bytecode, bool) {
+	l := lexer.NewFile(path, input)
+	p := parser.NewWithOptions(l, parser.Options{IncludePaths: includePaths, Defines: defines})
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		repl.PrintParserErrors(os.Stdout, p.Sources(), p.Errors())
+		return nil, false
+	}
+
+	comp := compiler.NewWithOptions(compiler.Options{ScratchRegister: uint8(scratch), Optimize: optimize})
+	err := comp.Compile(program)
+	if err != nil {
+		repl.PrintCompileError(os.Stdout, p.Sources(), err)
+		return nil, false
+	}
+	if optimize {
+		stats := comp.OptimizeStats()
+		fmt.Fprintf(os.Stdout, "Optimised %s: %d instructions before, %d after\n", path, stats.Before, stats.After)
+	}
+
+	if listing != "" {
+		f, err := os.Create(listing)
 		if err != nil {
-			fmt.Fprintf(os.Stdout, "Invalid file!")
-			return
+			fmt.Fprintf(os.Stdout, "Can't create %s: %s\n", listing, err)
+			return nil, false
 		}
-		if fi.IsDir() {
-			fmt.Fprintf(os.Stdout, "You can't load a directory!")
-			return
+		defer f.Close()
+		if err := comp.WriteListing(f, p.Sources()); err != nil {
+			fmt.Fprintf(os.Stdout, "Can't write %s: %s\n", listing, err)
+			return nil, false
 		}
-		f, _ := os.Open(*file)
-		input, err := ioutil.ReadAll(f)
+	}
+
+	return comp.Bytecode(), true
+}
+
+// Loads an object file as is, or assembles a source file
+func loadProgram(path string) (*compiler.Bytecode, bool) {
+	input, ok := readFile(path)
+	if !ok {
+		return nil, false
+	}
+
+	if object.IsObject(input) {
+		bytecode, err := object.Decode(input)
 		if err != nil {
-			fmt.Fprintf(os.Stdout, "An error occured trying to load the file! %s", err)
-			return
+			fmt.Fprintf(os.Stdout, "Can't load %s: %s\n", path, err)
+			return nil, false
 		}
+		return bytecode, true
+	}
+
+	return assemble(path, string(input), "")
+}
+
+func runFile(path string, maxSteps int, timeout time.Duration) {
+	bytecode, ok := loadProgram(path)
+	if !ok {
+		return
+	}
+
+	// Ctrl-C stops the program instead of the whole process
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	opts := vm.RunOptions{MaxInstructions: maxSteps, Context: ctx}
+	if timeout > 0 {
+		opts.Deadline = time.Now().Add(timeout)
+	}
+
+	machine := vm.New(bytecode)
+	repl.PrintResult(os.Stdout, machine.RunWithOptions(os.Stdout, opts))
+	signal.Stop(interrupt)
+	cancel()
+	fmt.Fprintf(os.Stdout, "------\nOutput:\nCounter: %d\nRegisters: %v\nFlags: %s\n",
+		machine.Counter, machine.Registers, machine.Flags)
+}
+
+// Assembles a source file into an object file
+func buildFile(args []string) bool {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	output := fs.String("o", "", "Object file to write, defaults to the source name with .sbc")
+	listing := fs.String("l", "", "Listing file to write, with the offset and bytes of each source line")
+	strip := fs.Bool("s", false, "Leave the symbol table, expansions and source map out of the object file")
+	fs.Var(&includePaths, "I", "Directory to search for .include files, can be repeated")
+	fs.Var(defines, "D", "Define a constant as NAME=value, or NAME for 1, can be repeated")
+	fs.Var(&scratch, "scratch", "Register pseudo-instructions may clobber")
+	fs.BoolVar(&optimize, "O", optimize, "Run the peephole optimiser over the assembled code")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stdout, "Usage: simpsel build [-o prog.sbc] [-l prog.lst] [-s] [-O] [-I dir] [-D NAME=value] [-scratch $30] prog.sasm\n")
+		return false
+	}
+	path := fs.Arg(0)
+
+	input, ok := readFile(path)
+	if !ok {
+		return false
+	}
+	bytecode, ok := assemble(path, string(input), *listing)
+	if !ok {
+		return false
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(path, filepath.Ext(path)) + ".sbc"
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "Can't create %s: %s\n", *output, err)
+		return false
+	}
+	defer f.Close()
+
+	if err := object.Write(f, bytecode, *strip); err != nil {
+		fmt.Fprintf(os.Stdout, "Can't write %s: %s\n", *output, err)
+		return false
+	}
+	return true
+}
+
+// Looks for likely mistakes in a source file without running it. Fails if
+// the file doesn't assemble, or has warnings and -werror is given.
+func checkFile(args []string) bool {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	werror := fs.Bool("werror", false, "Fail if there are any warnings")
+	fs.Var(&includePaths, "I", "Directory to search for .include files, can be repeated")
+	fs.Var(defines, "D", "Define a constant as NAME=value, or NAME for 1, can be repeated")
+	fs.Var(&scratch, "scratch", "Register pseudo-instructions may clobber")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stdout, "Usage: simpsel check [-werror] [-I dir] [-D NAME=value] [-scratch $30] prog.sasm\n")
+		return false
+	}
+	path := fs.Arg(0)
+
+	input, ok := readFile(path)
+	if !ok {
+		return false
+	}
+	p := parser.NewWithOptions(lexer.NewFile(path, string(input)),
+		parser.Options{IncludePaths: includePaths, Defines: defines})
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		repl.PrintParserErrors(os.Stdout, p.Sources(), p.Errors())
+		return false
+	}
+
+	comp := compiler.NewWithOptions(compiler.Options{ScratchRegister: uint8(scratch)})
+	if err := comp.Compile(program); err != nil {
+		repl.PrintCompileError(os.Stdout, p.Sources(), err)
+		return false
+	}
 
-		l := lexer.New(string(input))
-		p := parser.New(l)
+	diagnostics, err := lint.Check(comp)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "Can't check %s: %s\n", path, err)
+		return false
+	}
+	diag.RenderAll(os.Stdout, p.Sources(), diagnostics)
 
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			repl.PrintParserErrors(os.Stdout, p.Errors())
-			return
+	errors, warnings := 0, 0
+	for _, d := range diagnostics {
+		if d.Severity == diag.Error {
+			errors++
+		} else {
+			warnings++
 		}
+	}
+	if errors > 0 {
+		fmt.Fprintf(os.Stdout, "%s, ", plural(errors, "error"))
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", plural(warnings, "warning"))
+	// An error is certain to fault, so it fails the check even without -werror
+	return errors == 0 && (warnings == 0 || !*werror)
+}
+
+// Formats a count like `1 warning` or `2 warnings`
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
 
-		comp := compiler.New()
-		err = comp.Compile(program)
+// Writes the control flow graph of a source or object file as Graphviz DOT
+func graphFile(args []string) bool {
+	fs := flag.NewFlagSet("cfg", flag.ExitOnError)
+	output := fs.String("o", "", "DOT file to write, defaults to standard output")
+	fs.Var(&includePaths, "I", "Directory to search for .include files, can be repeated")
+	fs.Var(defines, "D", "Define a constant as NAME=value, or NAME for 1, can be repeated")
+	fs.Var(&scratch, "scratch", "Register pseudo-instructions may clobber")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stdout, "Usage: simpsel cfg [-o prog.dot] [-I dir] [-D NAME=value] [-scratch $30] prog.sasm\n")
+		return false
+	}
+	path := fs.Arg(0)
+
+	bytecode, ok := loadProgram(path)
+	if !ok {
+		return false
+	}
+	graph, err := cfg.Build(bytecode)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "Can't build the graph of %s: %s\n", path, err)
+		return false
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
 		if err != nil {
-			fmt.Fprintf(os.Stdout, "Woophs! Compilation failed:\n %s\n", err)
-			return
+			fmt.Fprintf(os.Stdout, "Can't create %s: %s\n", *output, err)
+			return false
 		}
+		defer f.Close()
+		out = f
+	}
+	if err := graph.WriteDOT(out); err != nil {
+		fmt.Fprintf(os.Stdout, "Can't write the graph: %s\n", err)
+		return false
+	}
+	return true
+}
 
-		machine := vm.New(comp.Bytecode())
-		machine.Run(os.Stdout)
-		fmt.Fprintf(os.Stdout, "------\nOutput:\nCounter: %d\nRegisters: %v\n", machine.Counter, machine.Registers)
-		return
+// Prints an object file, or a raw bytecode file, as simpsel assembly
+func disassembleFile(path string) {
+	if path == "" {
+		fmt.Fprintf(os.Stdout, "You must provide a file to disassemble!\n")
+		os.Exit(2)
+	}
+	input, ok := readFile(path)
+	if !ok {
+		os.Exit(1)
 	}
 
-	if *runSsh {
-		startSshServer(*addr)
-	} else {
-		repl.Start(os.Stdin, os.Stdout)
+	bytecode := &compiler.Bytecode{Instructions: input}
+	if object.IsObject(input) {
+		var err error
+		bytecode, err = object.Decode(input)
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "Can't load %s: %s\n", path, err)
+			os.Exit(1)
+		}
+	}
+
+	labels := []int{}
+	if bytecode.Entry != 0 {
+		labels = append(labels, bytecode.Entry)
+	}
+	notes := map[int]string{}
+	for _, exp := range bytecode.Expansions {
+		notes[exp.Offset] = exp.Source + " (pseudo-instruction)"
+	}
+	listing, err := code.DisassembleAnnotated(bytecode.Instructions, labels, notes)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "Can't disassemble %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	if len(bytecode.Data) > 0 {
+		fmt.Fprintf(os.Stdout, ".data\n%s.code\n", code.DisassembleData(bytecode.Data))
+	}
+	if bytecode.Entry != 0 {
+		fmt.Fprintf(os.Stdout, ".entry @%s\n", code.LabelName(bytecode.Entry))
 	}
+	fmt.Fprint(os.Stdout, listing)
 }
 
 func startSshServer(addr string) {
 	ssh.Handle(func(s ssh.Session) {
+		defer func() {
+			// A broken session must never take the other sessions down with it
+			if r := recover(); r != nil {
+				fmt.Fprintf(os.Stdout, "Session from %s crashed: %v\n", s.RemoteAddr(), r)
+				s.Close()
+			}
+		}()
 		fmt.Fprintf(os.Stdout, "New connection from: %s\n", s.RemoteAddr())
 		term := terminal.NewTerminal(s, "")
-		repl.StartTerminal(s, term)
+		repl.StartTerminal(s, term, uint8(scratch))
 	})
 
 	fmt.Fprintf(os.Stdout, "Starting SSH server @ %s\n", addr)
@@ -0,0 +1,330 @@
+// Package object reads and writes assembled simpsel programs (.sbc files).
+//
+// All numbers are little-endian. A file is laid out as:
+//
+//	magic     [4]byte  "SBC\x00"
+//	version   uint16   the code.ISAVersion the program was assembled for
+//	flags     uint16   which optional sections follow the data
+//	entry     uint32   offset of the first instruction to run
+//	codeLen   uint32
+//	dataLen   uint32
+//	code      [codeLen]byte
+//	data      [dataLen]byte
+//	symbols     only if FlagSymbols is set
+//	expansions  only if FlagExpansions is set
+//	source map  only if FlagSourceMap is set
+//	checksum    uint32   CRC-32 (IEEE) of everything before it
+//
+// The symbol table is a uint32 count followed by that many entries of
+// nameLen uint16, name [nameLen]byte, section byte, offset uint32, line uint32.
+//
+// The expansions record where pseudo-instructions were lowered, as a uint32
+// count followed by entries of offset uint32, length uint32,
+// sourceLen uint16, source [sourceLen]byte.
+//
+// The source map is a uint16 count of file names, each nameLen uint16,
+// name [nameLen]byte, followed by a uint32 count of entries of offset uint32,
+// length uint32, file uint16 (an index into the names), line uint32.
+package object
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"simpsel/code"
+	"simpsel/compiler"
+)
+
+var Magic = []byte("SBC\x00")
+
+const (
+	FlagSymbols    uint16 = 1 << iota // A symbol table follows the data
+	FlagExpansions                    // The pseudo-instruction expansions follow the symbols
+	FlagSourceMap                     // The source line of each instruction follows the expansions
+)
+
+const knownFlags = FlagSymbols | FlagExpansions | FlagSourceMap
+
+var sectionIDs = map[compiler.Section]byte{
+	compiler.CodeSection: 0,
+	compiler.DataSection: 1,
+}
+
+var sectionsByID = map[byte]compiler.Section{
+	0: compiler.CodeSection,
+	1: compiler.DataSection,
+}
+
+var ErrChecksum = errors.New("checksum mismatch, the file is corrupted")
+
+// Reports whether input starts like an object file
+func IsObject(input []byte) bool {
+	return bytes.HasPrefix(input, Magic)
+}
+
+// Serializes bytecode. The symbol table, expansions and source map are only
+// written when strip is false.
+func Write(w io.Writer, bytecode *compiler.Bytecode, strip bool) error {
+	var buf bytes.Buffer
+
+	flags := uint16(0)
+	if !strip && len(bytecode.Symbols) > 0 {
+		flags |= FlagSymbols
+	}
+	if !strip && len(bytecode.Expansions) > 0 {
+		flags |= FlagExpansions
+	}
+	if !strip && len(bytecode.SourceMap) > 0 {
+		flags |= FlagSourceMap
+	}
+
+	buf.Write(Magic)
+	writeUint16(&buf, code.ISAVersion)
+	writeUint16(&buf, flags)
+	writeUint32(&buf, uint32(bytecode.Entry))
+	writeUint32(&buf, uint32(len(bytecode.Instructions)))
+	writeUint32(&buf, uint32(len(bytecode.Data)))
+	buf.Write(bytecode.Instructions)
+	buf.Write(bytecode.Data)
+
+	if flags&FlagSymbols != 0 {
+		writeUint32(&buf, uint32(len(bytecode.Symbols)))
+		for _, sym := range bytecode.Symbols {
+			writeUint16(&buf, uint16(len(sym.Name)))
+			buf.WriteString(sym.Name)
+			buf.WriteByte(sectionIDs[sym.Section])
+			writeUint32(&buf, uint32(sym.Offset))
+			writeUint32(&buf, uint32(sym.Line))
+		}
+	}
+
+	if flags&FlagExpansions != 0 {
+		writeUint32(&buf, uint32(len(bytecode.Expansions)))
+		for _, exp := range bytecode.Expansions {
+			writeUint32(&buf, uint32(exp.Offset))
+			writeUint32(&buf, uint32(exp.Length))
+			writeUint16(&buf, uint16(len(exp.Source)))
+			buf.WriteString(exp.Source)
+		}
+	}
+
+	if flags&FlagSourceMap != 0 {
+		writeSourceMap(&buf, bytecode.SourceMap)
+	}
+
+	writeUint32(&buf, crc32.ChecksumIEEE(buf.Bytes()))
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func Read(r io.Reader) (*compiler.Bytecode, error) {
+	input, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return Decode(input)
+}
+
+func Decode(input []byte) (*compiler.Bytecode, error) {
+	if !IsObject(input) {
+		return nil, errors.New("not a simpsel object file")
+	}
+	if len(input) < len(Magic)+4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	body := input[:len(input)-4]
+	checksum := binary.LittleEndian.Uint32(input[len(input)-4:])
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, ErrChecksum
+	}
+
+	d := &decoder{input: body, pos: len(Magic)}
+
+	version := d.uint16()
+	flags := d.uint16()
+	entry := d.uint32()
+	codeLen := d.uint32()
+	dataLen := d.uint32()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if version != code.ISAVersion {
+		return nil, fmt.Errorf("ISA version %d not supported, expected version %d",
+			version, code.ISAVersion)
+	}
+	if flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("unknown flags %04X", flags&^knownFlags)
+	}
+
+	bytecode := &compiler.Bytecode{
+		Instructions: d.bytes(int(codeLen)),
+		Data:         d.bytes(int(dataLen)),
+		Entry:        int(entry),
+	}
+
+	if flags&FlagSymbols != 0 {
+		count := d.uint32()
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			name := string(d.bytes(int(d.uint16())))
+			section, ok := sectionsByID[d.byte()]
+			if !ok && d.err == nil {
+				return nil, fmt.Errorf("symbol %q has an unknown section", name)
+			}
+			bytecode.Symbols = append(bytecode.Symbols, compiler.Symbol{
+				Name:    name,
+				Section: section,
+				Offset:  int(d.uint32()),
+				Line:    int(d.uint32()),
+			})
+		}
+	}
+
+	if flags&FlagExpansions != 0 {
+		count := d.uint32()
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			bytecode.Expansions = append(bytecode.Expansions, compiler.Expansion{
+				Offset: int(d.uint32()),
+				Length: int(d.uint32()),
+				Source: string(d.bytes(int(d.uint16()))),
+			})
+		}
+	}
+
+	if flags&FlagSourceMap != 0 {
+		sourceMap, err := d.sourceMap()
+		if err != nil {
+			return nil, err
+		}
+		bytecode.SourceMap = sourceMap
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.pos != len(body) {
+		return nil, fmt.Errorf("%d unexpected bytes after the last section", len(body)-d.pos)
+	}
+	if len(bytecode.Instructions)%code.InstructionWidth != 0 {
+		return nil, fmt.Errorf("code segment is %d bytes, not a multiple of %d",
+			len(bytecode.Instructions), code.InstructionWidth)
+	}
+	if bytecode.Entry%code.InstructionWidth != 0 || bytecode.Entry > len(bytecode.Instructions) {
+		return nil, fmt.Errorf("entry point %d is not an instruction", bytecode.Entry)
+	}
+
+	return bytecode, nil
+}
+
+// File names are written once, and each entry refers to its file by index
+func writeSourceMap(buf *bytes.Buffer, sourceMap []compiler.SourceLine) {
+	files := []string{}
+	index := map[string]int{}
+	for _, line := range sourceMap {
+		if _, ok := index[line.File]; !ok {
+			index[line.File] = len(files)
+			files = append(files, line.File)
+		}
+	}
+
+	writeUint16(buf, uint16(len(files)))
+	for _, file := range files {
+		writeUint16(buf, uint16(len(file)))
+		buf.WriteString(file)
+	}
+
+	writeUint32(buf, uint32(len(sourceMap)))
+	for _, line := range sourceMap {
+		writeUint32(buf, uint32(line.Offset))
+		writeUint32(buf, uint32(line.Length))
+		writeUint16(buf, uint16(index[line.File]))
+		writeUint32(buf, uint32(line.Line))
+	}
+}
+
+func (d *decoder) sourceMap() ([]compiler.SourceLine, error) {
+	files := make([]string, d.uint16())
+	for i := range files {
+		files[i] = string(d.bytes(int(d.uint16())))
+	}
+
+	var sourceMap []compiler.SourceLine
+	count := d.uint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		line := compiler.SourceLine{Offset: int(d.uint32()), Length: int(d.uint32())}
+		file := int(d.uint16())
+		if file >= len(files) && d.err == nil {
+			return nil, fmt.Errorf("source map entry %d has an unknown file", i)
+		}
+		if d.err == nil {
+			line.File = files[file]
+		}
+		line.Line = int(d.uint32())
+		sourceMap = append(sourceMap, line)
+	}
+	return sourceMap, nil
+}
+
+// Reads fields in order, remembering the first error so callers can check once
+type decoder struct {
+	input []byte
+	pos   int
+	err   error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.pos+n > len(d.input) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	result := make([]byte, n)
+	copy(result, d.input[d.pos:])
+	d.pos += n
+	return result
+}
+
+func (d *decoder) byte() byte {
+	b := d.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func writeUint16(buf *bytes.Buffer, v uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
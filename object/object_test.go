@@ -0,0 +1,128 @@
+package object
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"simpsel/compiler"
+	"simpsel/compiler/compilertest"
+	"testing"
+)
+
+const source = `.data
+msg: .asciiz "hi"
+.code
+helper:
+ret
+start:
+load $0 @msg
+inc $0
+call @helper
+hlt
+.entry @start`
+
+func build(t *testing.T, input string) *compiler.Bytecode {
+	t.Helper()
+
+	return compilertest.Compile(t, input).Bytecode()
+}
+
+func encode(t *testing.T, bytecode *compiler.Bytecode, strip bool) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := Write(&buf, bytecode, strip); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Rewrites the trailing checksum so a deliberate edit isn't reported as corruption
+func reseal(input []byte) []byte {
+	body := input[:len(input)-4]
+	binary.LittleEndian.PutUint32(input[len(input)-4:], crc32.ChecksumIEEE(body))
+	return input
+}
+
+func TestRoundTrip(t *testing.T) {
+	expected := build(t, source)
+
+	actual, err := Read(bytes.NewReader(encode(t, expected, false)))
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("bytecode changed in the round trip.\nwant=%+v\ngot =%+v", expected, actual)
+	}
+
+	if actual.Entry != 4 {
+		t.Errorf("actual.Entry wrong. want=%d, got=%d", 4, actual.Entry)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	expected := build(t, source)
+
+	actual, err := Decode(encode(t, expected, true))
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	if actual.Symbols != nil {
+		t.Errorf("stripped file has symbols. got=%v", actual.Symbols)
+	}
+
+	if actual.Expansions != nil {
+		t.Errorf("stripped file has expansions. got=%v", actual.Expansions)
+	}
+
+	if actual.SourceMap != nil {
+		t.Errorf("stripped file has a source map. got=%v", actual.SourceMap)
+	}
+
+	if !bytes.Equal(expected.Instructions, actual.Instructions) {
+		t.Errorf("instructions changed. want=%v, got=%v",
+			expected.Instructions, actual.Instructions)
+	}
+}
+
+func TestRejectsBadFiles(t *testing.T) {
+	valid := encode(t, build(t, source), false)
+	clone := func() []byte { return append([]byte{}, valid...) }
+
+	corrupted := clone()
+	corrupted[20] ^= 0xFF
+
+	badVersion := clone()
+	binary.LittleEndian.PutUint16(badVersion[4:], 0xFFFF)
+	reseal(badVersion)
+
+	badFlags := clone()
+	binary.LittleEndian.PutUint16(badFlags[6:], 0x8000)
+	reseal(badFlags)
+
+	badEntry := clone()
+	binary.LittleEndian.PutUint32(badEntry[8:], 2)
+	reseal(badEntry)
+
+	truncated := reseal(clone()[:30])
+
+	tests := map[string][]byte{
+		"corrupted":   corrupted,
+		"bad version": badVersion,
+		"bad flags":   badFlags,
+		"bad entry":   badEntry,
+		"truncated":   truncated,
+		"bad magic":   []byte("not an object file"),
+		"empty":       {},
+	}
+
+	for name, input := range tests {
+		if _, err := Decode(input); err == nil {
+			t.Errorf("%s: expected an error, got none", name)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package parser
+
+import (
+	"simpsel/token"
+	"strconv"
+)
+
+// A constant defined with `.equ NAME #value`, or from Options.Defines
+type constant struct {
+	value int64
+	tok   token.Token // The name in the .equ, the zero token for a define
+}
+
+// An .if, .ifdef or .ifndef block
+type condition struct {
+	tok    token.Token // The directive that opened the block
+	outer  bool        // Whether the block around this one is being assembled
+	active bool        // Whether the current branch is being assembled
+	inElse bool        // Whether .else has been seen
+}
+
+// Handles the conditional directives, returning whether tok was one
+func (pp *preprocessor) conditional(tok token.Token) bool {
+	switch tok.Type {
+	case token.IF, token.IFDEF, token.IFNDEF:
+		c := &condition{tok: tok, outer: !pp.skipping()}
+		if c.outer {
+			c.active = pp.evaluate(tok)
+		} else {
+			pp.readLine(tok)
+		}
+		pp.conditions = append(pp.conditions, c)
+	case token.ELSE:
+		if len(pp.conditions) == 0 {
+			pp.errorAt(tok, ".else without an .if")
+			return true
+		}
+		c := pp.conditions[len(pp.conditions)-1]
+		if c.inElse {
+			pp.errorAt(tok, "the .%s on line %d already has an .else", c.tok.Literal, c.tok.Line)
+			return true
+		}
+		c.inElse = true
+		c.active = !c.active
+	case token.ENDIF:
+		if len(pp.conditions) == 0 {
+			pp.errorAt(tok, ".endif without an .if")
+			return true
+		}
+		pp.conditions = pp.conditions[:len(pp.conditions)-1]
+	case token.EOF:
+		for _, c := range pp.conditions {
+			pp.errorAt(c.tok, ".%s is missing its .endif", c.tok.Literal)
+		}
+		pp.conditions = nil
+		return false
+	default:
+		return false
+	}
+	return true
+}
+
+// Whether tokens are being thrown away because they're in a branch that isn't taken
+func (pp *preprocessor) skipping() bool {
+	if len(pp.conditions) == 0 {
+		return false
+	}
+	c := pp.conditions[len(pp.conditions)-1]
+	return !c.outer || !c.active
+}
+
+// Reads the condition following an .if, .ifdef or .ifndef and works out whether it holds
+func (pp *preprocessor) evaluate(directive token.Token) bool {
+	args := pp.readLine(directive)
+	if len(args) != 1 {
+		pp.errorAt(directive, ".%s needs exactly one operand, got %d", directive.Literal, len(args))
+		return false
+	}
+	arg := args[0]
+
+	if directive.Type == token.IF {
+		value, ok := pp.value(arg)
+		return ok && value != 0
+	}
+
+	if arg.Type != token.IDENT && arg.Type != token.CONST {
+		pp.errorAt(arg, "expected a constant name, got %s", arg.Type)
+		return false
+	}
+	_, defined := pp.constants[arg.Literal]
+	return defined == (directive.Type == token.IFDEF)
+}
+
+// Reads the name and value following an .equ
+func (pp *preprocessor) defineConstant(directive token.Token) {
+	args := pp.readLine(directive)
+	if len(args) != 2 {
+		pp.errorAt(directive, ".equ needs a name and a value")
+		return
+	}
+
+	name := args[0]
+	if name.Type != token.IDENT {
+		pp.errorAt(name, "can't use %q as a constant name", name.Literal)
+		return
+	}
+	if prev, ok := pp.constants[name.Literal]; ok {
+		if prev.tok.Line == 0 {
+			pp.errorAt(name, "constant %q is already defined on the command line", name.Literal)
+		} else {
+			pp.errorAt(name, "constant %q already defined on line %d", name.Literal, prev.tok.Line)
+		}
+		return
+	}
+
+	value, ok := pp.value(args[1])
+	if !ok {
+		return
+	}
+	pp.constants[name.Literal] = &constant{value: value, tok: name}
+}
+
+// The value of an #int or #NAME operand
+func (pp *preprocessor) value(tok token.Token) (int64, bool) {
+	switch tok.Type {
+	case token.INT:
+		value, err := ParseInteger(tok.Literal)
+		if err != nil {
+			pp.errorAt(tok, "%s", err)
+			return 0, false
+		}
+		return value, true
+	case token.CONST:
+		c, ok := pp.constants[tok.Literal]
+		if !ok {
+			pp.errorAt(tok, "undefined constant %q", tok.Literal)
+			return 0, false
+		}
+		return c.value, true
+	default:
+		pp.errorAt(tok, "expected a value like #1 or #NAME, got %s", tok.Type)
+		return 0, false
+	}
+}
+
+// Turns a #NAME operand into the integer it stands for, so the parser can
+// take it anywhere it takes an #int
+func (pp *preprocessor) substitute(tok token.Token) token.Token {
+	value, ok := pp.value(tok)
+	if !ok {
+		value = 0 // Already reported, don't pile a parse error on top
+	}
+
+	tok.Type = token.INT
+	tok.Literal = strconv.FormatInt(value, 10)
+	return tok
+}
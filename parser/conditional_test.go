@@ -0,0 +1,108 @@
+package parser
+
+import (
+	"simpsel/lexer"
+	"testing"
+)
+
+func TestConstants(t *testing.T) {
+	tests := []struct {
+		input    string
+		defines  map[string]int64
+		expected string
+	}{
+		{".equ SIZE #16\nload $1 #SIZE", nil, "load $1 #16;"},
+		{".equ MASK, #0xFF\n.data\n.byte #MASK\n.word #MASK", nil, ".data.byte #255;.word #255;"},
+		{".equ A #-2\n.equ B #A\nload $1 #B", nil, "load $1 #-2;"},
+		{"load $1 #WIDTH", map[string]int64{"WIDTH": 70000}, "load $1 #70000;"},
+		{".macro setn r\nload r #N\n.endm\n.equ N #3\nsetn $2", nil, "load $2 #3;"},
+		// The value can go without a #
+		{".equ N 4\nload $1 #N", nil, "load $1 #4;"},
+		{".equ N, -0x10\nload $1 #N", nil, "load $1 #-16;"},
+		{".equ C 'A'\n.if 1\nload $1 #C\n.endif", nil, "load $1 #65;"},
+	}
+
+	for _, tt := range tests {
+		p := NewWithOptions(lexer.New(tt.input), Options{Defines: tt.defines})
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong program for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	debug := map[string]int64{"DEBUG": 1}
+	off := map[string]int64{"DEBUG": 0}
+
+	tests := []struct {
+		input    string
+		defines  map[string]int64
+		expected string
+	}{
+		{".ifdef DEBUG\nnop\n.else\nhlt\n.endif", debug, "nop;"},
+		{".ifdef DEBUG\nnop\n.else\nhlt\n.endif", nil, "hlt;"},
+		{".ifndef DEBUG\nnop\n.endif\nhlt", nil, "nop;hlt;"},
+		{".if #DEBUG\nnop\n.else\nhlt\n.endif", off, "hlt;"},
+		{".if #DEBUG\nnop\n.else\nhlt\n.endif", debug, "nop;"},
+		{
+			// Nothing inside a skipped block is assembled, however deep it goes
+			".if #0\n.if #0\nnop\n.else\nload $1 #1\n.endif\n.equ X #1\n.endif\nret\n.ifdef X\nhlt\n.endif",
+			nil,
+			"ret;",
+		},
+		{
+			// Conditions in a macro are checked each time it's expanded
+			".macro trace r\n.ifdef DEBUG\npush r\n.endif\n.endm\ntrace $4",
+			debug,
+			"push $4;",
+		},
+	}
+
+	for _, tt := range tests {
+		p := NewWithOptions(lexer.New(tt.input), Options{Defines: tt.defines})
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong program for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestConditionalErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"load $1 #X", `undefined constant "X"`},
+		{".equ A #1\n.equ A #2", `constant "A" already defined on line 1`},
+		{".equ DEBUG #1", `constant "DEBUG" is already defined on the command line`},
+		{".equ A", ".equ needs a name and a value"},
+		{".equ load #1", `can't use "load" as a constant name`},
+		{".endif", ".endif without an .if"},
+		{".else", ".else without an .if"},
+		{".if #1\n.else\n.else\n.endif", "the .if on line 1 already has an .else"},
+		{".ifdef A\nnop", ".ifdef is missing its .endif"},
+		{".if\nnop\n.endif", ".if needs exactly one operand, got 0"},
+		{".ifdef #1\n.endif", "expected a constant name, got INT"},
+		{".if $1\n.endif", "expected a value like #1 or #NAME, got REGISTER"},
+		{".equ N 4\nload $1 4", "expected next token to be INT, got ILLEGAL instead"},
+	}
+
+	for _, tt := range tests {
+		p := NewWithOptions(lexer.New(tt.input), Options{Defines: map[string]int64{"DEBUG": 1}})
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected an error for %q, got none", tt.input)
+			continue
+		}
+
+		if p.Errors()[0].Message != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, p.Errors()[0].Message)
+		}
+	}
+}
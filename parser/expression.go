@@ -0,0 +1,127 @@
+package parser
+
+import (
+	"simpsel/ast"
+	"simpsel/token"
+	"strings"
+)
+
+// Parses an #int operand. Literals are range checked here, constant
+// expressions like #(SIZE*4) are checked by the compiler once it has worked
+// them out, since they can use labels.
+func (p *Parser) parseImmediate(min, max int64, field string) ast.Expression {
+	if p.peekTokenIs(token.LPAREN) || p.peekTokenIs(token.FUNCTION) {
+		p.nextToken()
+		// Only the bracketed part belongs to the operand, so stop before any infix operator
+		return p.parseExpression(PREFIX)
+	}
+
+	if !p.expectPeek(token.INT) {
+		return nil
+	}
+	val := p.parseIntegerLiteral()
+	if val == nil || p.outOfRangeError(val.Value, min, max, field) {
+		return nil
+	}
+	return val
+}
+
+func (p *Parser) parseExpression(precedence int) ast.Expression {
+	prefix := p.prefixParseFns[p.curToken.Type]
+	if prefix == nil {
+		p.errorAt(p.curToken, "unexpected %s in expression", p.curToken.Type)
+		return nil
+	}
+	left := prefix()
+
+	for left != nil && precedence < p.peekPrecedence() {
+		infix := p.infixParseFns[p.peekToken.Type]
+		if infix == nil {
+			return left
+		}
+		p.nextToken()
+		left = infix(left)
+	}
+
+	return left
+}
+
+func (p *Parser) peekPrecedence() int {
+	if p, ok := precedences[p.peekToken.Type]; ok {
+		return p
+	}
+	return LOWEST
+}
+
+func (p *Parser) curPrecedence() int {
+	if p, ok := precedences[p.curToken.Type]; ok {
+		return p
+	}
+	return LOWEST
+}
+
+func (p *Parser) parseIntegerExpression() ast.Expression {
+	lit := p.parseIntegerLiteral()
+	if lit == nil {
+		return nil
+	}
+	return lit
+}
+
+func (p *Parser) parseLabelReference() ast.Expression {
+	return &ast.LabelReference{Token: p.curToken, Name: p.curToken.Literal}
+}
+
+func (p *Parser) parsePrefixExpression() ast.Expression {
+	expression := &ast.PrefixExpression{Token: p.curToken, Operator: p.curToken.Literal}
+
+	p.nextToken()
+	expression.Right = p.parseExpression(PREFIX)
+	if expression.Right == nil {
+		return nil
+	}
+	return expression
+}
+
+func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
+	expression := &ast.InfixExpression{
+		Token:    p.curToken,
+		Left:     left,
+		Operator: p.curToken.Literal,
+	}
+
+	precedence := p.curPrecedence()
+	p.nextToken()
+	expression.Right = p.parseExpression(precedence)
+	if expression.Right == nil {
+		return nil
+	}
+	return expression
+}
+
+func (p *Parser) parseGroupedExpression() ast.Expression {
+	p.nextToken()
+
+	expression := p.parseExpression(LOWEST)
+	if expression == nil || !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	return expression
+}
+
+func (p *Parser) parseCallExpression() ast.Expression {
+	call := &ast.CallExpression{Token: p.curToken, Function: strings.ToUpper(p.curToken.Literal)}
+	if call.Function != "HIGH" && call.Function != "LOW" {
+		p.errorAt(p.curToken, "unknown function %q, expected HIGH or LOW", p.curToken.Literal)
+		return nil
+	}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	call.Argument = p.parseGroupedExpression()
+	if call.Argument == nil {
+		return nil
+	}
+	return call
+}
@@ -0,0 +1,127 @@
+package parser
+
+import (
+	"fmt"
+	"simpsel/token"
+)
+
+// How many macro calls deep an expansion may go before it's treated as runaway recursion
+const maxExpansionDepth = 32
+
+// A macro defined with `.macro name param, param` ... `.endm`
+type macro struct {
+	name   token.Token
+	params []string
+	body   []token.Token
+}
+
+// Reads a definition up to and including its .endm
+func (pp *preprocessor) define(directive token.Token) {
+	var m *macro
+
+	header := pp.readLine(directive)
+	if len(header) == 0 {
+		pp.errorAt(directive, ".macro needs a name")
+	} else if header[0].Type != token.IDENT {
+		pp.errorAt(header[0], "can't use %q as a macro name", header[0].Literal)
+	} else if prev, ok := pp.macros[header[0].Literal]; ok {
+		pp.errorAt(header[0], "macro %q already defined on line %d", header[0].Literal, prev.name.Line)
+	} else {
+		m = &macro{name: header[0], params: pp.readParams(header[1:])}
+	}
+
+	for {
+		tok := pp.read()
+		switch tok.Type {
+		case token.EOF:
+			pp.errorAt(directive, "macro is missing its .endm")
+			pp.unread(tok)
+			return
+		case token.ENDM:
+			if m != nil {
+				pp.macros[m.name.Literal] = m
+			}
+			return
+		case token.MACRO:
+			pp.errorAt(tok, "macros can't be defined inside another macro")
+		default:
+			if m != nil {
+				m.body = append(m.body, tok)
+			}
+		}
+	}
+}
+
+func (pp *preprocessor) readParams(tokens []token.Token) []string {
+	params := []string{}
+	for _, tok := range tokens {
+		if tok.Type != token.IDENT {
+			pp.errorAt(tok, "can't use %q as a macro parameter", tok.Literal)
+			continue
+		}
+		if indexOf(params, tok.Literal) >= 0 {
+			pp.errorAt(tok, "duplicate macro parameter %q", tok.Literal)
+			continue
+		}
+		params = append(params, tok.Literal)
+	}
+	return params
+}
+
+// Queues up the body of m with the call's arguments substituted for its
+// parameters. Labels declared in the body get a name unique to this expansion,
+// so a macro with a loop in it can be used more than once.
+func (pp *preprocessor) expand(call token.Token, m *macro) {
+	args := pp.readLine(call)
+	if len(args) != len(m.params) {
+		pp.errorAt(call, "macro %q takes %d arguments, got %d", m.name.Literal, len(m.params), len(args))
+		return
+	}
+
+	depth := 0
+	for from := call.From; from != nil; from = from.From {
+		depth++
+	}
+	if depth >= maxExpansionDepth {
+		pp.errorAt(call, "macro %q nests too deeply, does it call itself?", m.name.Literal)
+		return
+	}
+
+	pp.expansions++
+	locals := map[string]bool{}
+	for _, tok := range m.body {
+		if tok.Type == token.LABEL {
+			locals[tok.Literal] = true
+		}
+	}
+
+	site := call
+	expansion := make([]token.Token, 0, len(m.body))
+	for _, tok := range m.body {
+		tok.From = &site
+		switch {
+		case tok.Type == token.IDENT || tok.Type == token.CONST:
+			// Parameters can be used as #name too, or bare inside an expression
+			if i := indexOf(m.params, tok.Literal); i >= 0 {
+				tok.Type = args[i].Type
+				tok.Literal = args[i].Literal
+			}
+		case tok.Type == token.LABEL || tok.Type == token.LABEL_REF:
+			if locals[tok.Literal] {
+				tok.Literal = fmt.Sprintf("%s.%d.%s", m.name.Literal, pp.expansions, tok.Literal)
+			}
+		}
+		expansion = append(expansion, tok)
+	}
+
+	pp.frames = append(pp.frames, &frame{tokens: expansion})
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
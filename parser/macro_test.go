@@ -0,0 +1,105 @@
+package parser
+
+import (
+	"simpsel/lexer"
+	"testing"
+)
+
+func TestMacroExpansion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			".macro twice reg\nadd reg reg reg\n.endm\ntwice $1\ntwice $2",
+			"add $1 $1 $1;add $2 $2 $2;",
+		},
+		{
+			".macro jeq a, b, target\nload $30 target\neq a b\njmpe $30\n.endm\njeq $1, $2, @done\ndone:\nhlt",
+			"load $30 @done;eq $1 $2;jmpe $30;done:hlt;",
+		},
+		{
+			// Each expansion gets its own copy of the body's labels
+			".macro spin\nloop:\nload $31 @loop\njmp $31\n.endm\nspin\nspin",
+			"spin.1.loop:load $31 @spin.1.loop;jmp $31;spin.2.loop:load $31 @spin.2.loop;jmp $31;",
+		},
+		{
+			// Macros can call other macros, and a comment can follow the arguments
+			".macro one r\nload r #1\n.endm\n.macro two r, s\none r\none s\n.endm\ntwo $1 $2 ; both\nhlt",
+			"load $1 #1;load $2 #1;hlt;",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong expansion for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"frob $1", `unknown instruction "frob"`},
+		{".macro m a\nnop\n.endm\nm", `macro "m" takes 1 arguments, got 0`},
+		{".macro m\nnop", "macro is missing its .endm"},
+		{".endm", ".endm without a .macro"},
+		{".macro\n.endm", ".macro needs a name"},
+		{".macro add\n.endm", `can't use "add" as a macro name`},
+		{".macro m a, a\n.endm", `duplicate macro parameter "a"`},
+		{".macro m\n.endm\n.macro m\n.endm", `macro "m" already defined on line 1`},
+		{".macro m\n.macro n\n.endm", "macros can't be defined inside another macro"},
+		{".macro m\nm\n.endm\nm", `macro "m" nests too deeply, does it call itself?`},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected an error for %q, got none", tt.input)
+			continue
+		}
+
+		if p.Errors()[0].Message != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, p.Errors()[0].Message)
+		}
+	}
+}
+
+func TestMacroErrorPositions(t *testing.T) {
+	input := ".macro seta r\n  load r #1\n.endm\nhlt\nseta $1\nseta #2"
+
+	l := lexer.New(input)
+	p := New(l)
+	p.ParseProgram()
+
+	if len(p.Errors()) == 0 {
+		t.Fatalf("expected parser errors, got none")
+	}
+
+	// The error points at the line inside the macro, with a note for the call
+	d := p.Errors()[0]
+	if d.Span.Start.Line != 2 || d.Span.Start.Column != 8 {
+		t.Errorf("wrong span. want=2:8, got=%d:%d", d.Span.Start.Line, d.Span.Start.Column)
+	}
+
+	if len(d.Notes) != 1 {
+		t.Fatalf("expected 1 note. got=%d", len(d.Notes))
+	}
+	note := d.Notes[0]
+	if note.Span.Start.Line != 6 || note.Span.Start.Column != 1 {
+		t.Errorf("wrong note span. want=6:1, got=%d:%d", note.Span.Start.Line, note.Span.Start.Column)
+	}
+	if note.Message != `in expansion of macro "seta"` {
+		t.Errorf("wrong note message. got=%q", note.Message)
+	}
+}
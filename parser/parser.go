@@ -2,10 +2,14 @@ package parser
 
 import (
 	"fmt"
+	"math"
 	"simpsel/ast"
+	"simpsel/diag"
 	"simpsel/lexer"
 	"simpsel/token"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -13,10 +17,17 @@ const (
 	LOWEST
 	OPCODE     // load, add, etc.
 	DIRECTIVES // .code / .data
+	BITOR      // |
+	BITAND     // &
+	SHIFT      // << or >>
+	SUM        // + or -
+	PRODUCT    // *, / or %
+	PREFIX     // -X
 )
 
 var precedences = map[token.TokenType]int {
 	token.LOAD: OPCODE,
+	token.LUI: OPCODE,
 	token.ADD: OPCODE,
 	token.SUB: OPCODE,
 	token.MUL: OPCODE,
@@ -33,61 +44,225 @@ var precedences = map[token.TokenType]int {
 	token.LTE: OPCODE,
 	token.JMPE: OPCODE,
 	token.NOP: OPCODE,
+	token.LB: OPCODE,
+	token.LW: OPCODE,
+	token.SB: OPCODE,
+	token.SW: OPCODE,
+	token.ALLOC: OPCODE,
+	token.PUSH: OPCODE,
+	token.POP: OPCODE,
+	token.CALL: OPCODE,
+	token.RET: OPCODE,
+	token.AND: OPCODE,
+	token.OR: OPCODE,
+	token.XOR: OPCODE,
+	token.NOT: OPCODE,
+	token.SHL: OPCODE,
+	token.SHR: OPCODE,
+	token.SAR: OPCODE,
+	token.MOD: OPCODE,
+	token.REM: OPCODE,
+	token.SETEQ: OPCODE,
+	token.SETNEQ: OPCODE,
+	token.SETGT: OPCODE,
+	token.SETLT: OPCODE,
+	token.SETGTE: OPCODE,
+	token.SETLTE: OPCODE,
+	token.JMPNE: OPCODE,
+	token.JZ: OPCODE,
+	token.JNZ: OPCODE,
+	token.JN: OPCODE,
+	token.JNN: OPCODE,
+	token.JC: OPCODE,
+	token.JNC: OPCODE,
+	token.JO: OPCODE,
+	token.JNO: OPCODE,
+	token.ADDI: OPCODE,
+	token.SUBI: OPCODE,
+	token.MULI: OPCODE,
+	token.EQI: OPCODE,
+	token.NEQI: OPCODE,
+	token.GTI: OPCODE,
+	token.LTI: OPCODE,
+	token.GTEI: OPCODE,
+	token.LTEI: OPCODE,
+	token.CMPI: OPCODE,
+	token.CODE: DIRECTIVES,
+	token.DATA: DIRECTIVES,
+	token.BYTE: DIRECTIVES,
+	token.WORD: DIRECTIVES,
+	token.ASCIIZ: DIRECTIVES,
+	token.SPACE: DIRECTIVES,
+	token.ENTRY: DIRECTIVES,
+	token.PIPE: BITOR,
+	token.AMPERSAND: BITAND,
+	token.LSHIFT: SHIFT,
+	token.RSHIFT: SHIFT,
+	token.PLUS: SUM,
+	token.MINUS: SUM,
+	token.ASTERISK: PRODUCT,
+	token.SLASH: PRODUCT,
+	token.PERCENT: PRODUCT,
 }
 
 type (
 	opCodeParseFn func() ast.Instruction
+	prefixParseFn func() ast.Expression
+	infixParseFn  func(ast.Expression) ast.Expression
 )
 
 type Parser struct {
-	l *lexer.Lexer
-	errors []string
+	l *preprocessor
+	errors []*diag.Diagnostic
 
 	curToken token.Token
 	peekToken token.Token
 
 	opCodeParseFns map[token.TokenType]opCodeParseFn
+	prefixParseFns map[token.TokenType]prefixParseFn
+	infixParseFns  map[token.TokenType]infixParseFn
+}
+
+// Settings for the assembler front end, usually from the command line
+type Options struct {
+	IncludePaths []string         // Searched for .include files that aren't next to the file including them
+	Defines      map[string]int64 // Constants defined before any source is read, like .equ
+	NoIncludes   bool             // Rejects .include, for source that mustn't read files on this machine
 }
 
 func New(l *lexer.Lexer) *Parser {
+	return NewWithOptions(l, Options{})
+}
+
+func NewWithOptions(l *lexer.Lexer, opts Options) *Parser {
 	p := &Parser{
-		l: l,
-		errors: []string{},
+		errors: []*diag.Diagnostic{},
 		opCodeParseFns: make(map[token.TokenType]opCodeParseFn),
+		prefixParseFns: make(map[token.TokenType]prefixParseFn),
+		infixParseFns: make(map[token.TokenType]infixParseFn),
 	}
+	p.l = newPreprocessor(l, opts, p.errorAt)
 
 	// Ignore comments bb
 	p.registerParseFn(token.COMMENT, p.parseIgnore)
 
+	// label:
+	p.registerParseFn(token.LABEL, p.parseLabel)
+
 	// directive
+	p.registerParseFn(token.CODE, p.parseSection)
+	p.registerParseFn(token.DATA, p.parseSection)
+	p.registerParseFn(token.BYTE, p.parseDataValues)
+	p.registerParseFn(token.WORD, p.parseDataValues)
+	p.registerParseFn(token.ASCIIZ, p.parseString)
+	p.registerParseFn(token.SPACE, p.parseSpace)
+	p.registerParseFn(token.ENTRY, p.parseEntry)
+
+	// Not a mnemonic or a macro
+	p.registerParseFn(token.IDENT, p.parseUnknown)
 
 	// op
 	p.registerParseFn(token.HLT, p.parseBlank)
 	p.registerParseFn(token.ILLEGAL, p.parseBlank)
 	p.registerParseFn(token.NOP, p.parseBlank)
+	p.registerParseFn(token.RET, p.parseBlank)
 
 	// op $Reg
-	p.registerParseFn(token.JMP, p.parseRegister)
 	p.registerParseFn(token.JMPF, p.parseRegister)
 	p.registerParseFn(token.JMPB, p.parseRegister)
 	p.registerParseFn(token.JMPE, p.parseRegister)
+	p.registerParseFn(token.JMPNE, p.parseRegister)
+	p.registerParseFn(token.JZ, p.parseRegister)
+	p.registerParseFn(token.JNZ, p.parseRegister)
+	p.registerParseFn(token.JN, p.parseRegister)
+	p.registerParseFn(token.JNN, p.parseRegister)
+	p.registerParseFn(token.JC, p.parseRegister)
+	p.registerParseFn(token.JNC, p.parseRegister)
+	p.registerParseFn(token.JO, p.parseRegister)
+	p.registerParseFn(token.JNO, p.parseRegister)
+	p.registerParseFn(token.REM, p.parseRegister)
+	p.registerParseFn(token.PUSH, p.parseRegister)
+	p.registerParseFn(token.POP, p.parseRegister)
+
+	// op $Reg | @Label
+	p.registerParseFn(token.CALL, p.parseRegisterOrLabel)
+	p.registerParseFn(token.JMP, p.parseRegisterOrLabel)
 
 	// op $Reg #Int
 	p.registerParseFn(token.LOAD, p.parseRegisterInt)
+	p.registerParseFn(token.LUI, p.parseRegisterInt)
+
+	// op $Reg #Imm
+	p.registerParseFn(token.ADDI, p.parseRegisterImmediate)
+	p.registerParseFn(token.SUBI, p.parseRegisterImmediate)
+	p.registerParseFn(token.MULI, p.parseRegisterImmediate)
+	p.registerParseFn(token.EQI, p.parseRegisterImmediate)
+	p.registerParseFn(token.NEQI, p.parseRegisterImmediate)
+	p.registerParseFn(token.GTI, p.parseRegisterImmediate)
+	p.registerParseFn(token.LTI, p.parseRegisterImmediate)
+	p.registerParseFn(token.GTEI, p.parseRegisterImmediate)
+	p.registerParseFn(token.LTEI, p.parseRegisterImmediate)
+	p.registerParseFn(token.CMPI, p.parseRegisterImmediate)
+
+	// op $Reg $Reg | #Imm
+	p.registerParseFn(token.EQ, p.parseCompare)
+	p.registerParseFn(token.NEQ, p.parseCompare)
+	p.registerParseFn(token.GT, p.parseCompare)
+	p.registerParseFn(token.LT, p.parseCompare)
+	p.registerParseFn(token.GTE, p.parseCompare)
+	p.registerParseFn(token.LTE, p.parseCompare)
 
 	// op $Reg $Reg
-	p.registerParseFn(token.EQ, p.parseRegisterRegister)
-	p.registerParseFn(token.NEQ, p.parseRegisterRegister)
-	p.registerParseFn(token.GT, p.parseRegisterRegister)
-	p.registerParseFn(token.LT, p.parseRegisterRegister)
-	p.registerParseFn(token.GTE, p.parseRegisterRegister)
-	p.registerParseFn(token.LTE, p.parseRegisterRegister)
+	p.registerParseFn(token.LB, p.parseRegisterRegister)
+	p.registerParseFn(token.LW, p.parseRegisterRegister)
+	p.registerParseFn(token.SB, p.parseRegisterRegister)
+	p.registerParseFn(token.SW, p.parseRegisterRegister)
+	p.registerParseFn(token.ALLOC, p.parseRegisterRegister)
+	p.registerParseFn(token.NOT, p.parseRegisterRegister)
+
+	// op $Reg $Reg | #Imm $Reg
+	p.registerParseFn(token.ADD, p.parseArithmetic)
+	p.registerParseFn(token.SUB, p.parseArithmetic)
+	p.registerParseFn(token.MUL, p.parseArithmetic)
 
 	// op $Reg $Reg $Reg
-	p.registerParseFn(token.ADD, p.parseRegisterRegisterRegister)
-	p.registerParseFn(token.SUB, p.parseRegisterRegisterRegister)
-	p.registerParseFn(token.MUL, p.parseRegisterRegisterRegister)
 	p.registerParseFn(token.DIV, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.AND, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.OR, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.XOR, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SHL, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SHR, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SAR, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.MOD, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SETEQ, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SETNEQ, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SETGT, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SETLT, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SETGTE, p.parseRegisterRegisterRegister)
+	p.registerParseFn(token.SETLTE, p.parseRegisterRegisterRegister)
+
+	// Pseudo-instructions
+	p.registerParseFn(token.INC, p.parseRegister)
+	p.registerParseFn(token.DEC, p.parseRegister)
+	p.registerParseFn(token.CLR, p.parseRegister)
+	p.registerParseFn(token.MOV, p.parseRegisterRegister)
+	p.registerParseFn(token.JMPZ, p.parseRegisterLabel)
+
+	// Constant expressions
+	p.prefixParseFns[token.INT] = p.parseIntegerExpression
+	p.prefixParseFns[token.LABEL_REF] = p.parseLabelReference
+	p.prefixParseFns[token.MINUS] = p.parsePrefixExpression
+	p.prefixParseFns[token.LPAREN] = p.parseGroupedExpression
+	p.prefixParseFns[token.FUNCTION] = p.parseCallExpression
+	p.infixParseFns[token.PIPE] = p.parseInfixExpression
+	p.infixParseFns[token.AMPERSAND] = p.parseInfixExpression
+	p.infixParseFns[token.LSHIFT] = p.parseInfixExpression
+	p.infixParseFns[token.RSHIFT] = p.parseInfixExpression
+	p.infixParseFns[token.PLUS] = p.parseInfixExpression
+	p.infixParseFns[token.MINUS] = p.parseInfixExpression
+	p.infixParseFns[token.ASTERISK] = p.parseInfixExpression
+	p.infixParseFns[token.SLASH] = p.parseInfixExpression
+	p.infixParseFns[token.PERCENT] = p.parseInfixExpression
 
 	// Read two tokens, so both curToken and peekToken are set
 	p.nextToken()
@@ -119,25 +294,40 @@ func (p *Parser) expectPeek(t token.TokenType) bool {
 	}
 }
 
-func (p *Parser) Errors() []string {
+func (p *Parser) Errors() []*diag.Diagnostic {
 	return p.errors
 }
 
+// The text of the program and every file it included, for rendering diagnostics
+func (p *Parser) Sources() diag.Sources {
+	return p.l.sources
+}
+
+func (p *Parser) errorAt(tok token.Token, format string, a ...interface{}) {
+	p.errors = append(p.errors, diag.Errorf(tok, format, a...))
+}
+
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
+	p.errorAt(p.peekToken, "expected next token to be %s, got %s instead",
 		t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
 }
 
 func (p *Parser) noParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.errorAt(p.curToken, "no parse function for %s found", t)
+}
+
+func (p *Parser) registerTooBigError(regNum int) bool {
+	if regNum > 31 {
+		p.errorAt(p.curToken, "register number too big, must be less than 32. got=%d", regNum)
+		return true
+	}
+	return false
 }
 
-func (p *Parser) registerTooBigError(regNum uint8) bool {
-	if regNum > uint8(31) {
-		msg := fmt.Sprintf("register number too big, must be less than 32. got=%d", regNum)
-		p.errors = append(p.errors, msg)
+func (p *Parser) outOfRangeError(val, min, max int64, field string) bool {
+	if val < min || val > max {
+		p.errorAt(p.curToken, "value %d does not fit in %s, must be between %d and %d",
+			val, field, min, max)
 		return true
 	}
 	return false
@@ -189,22 +379,30 @@ func (p *Parser) parseRegisterInt() ast.Instruction {
 		Value: uint8(reg),
 	}
 
-	if p.registerTooBigError(byte(reg)) {
+	if p.registerTooBigError(reg) {
 		return nil
 	}
 
-	if !p.expectPeek(token.INT) {
-		return nil
+	if p.peekTokenIs(token.LABEL_REF) {
+		p.nextToken()
+		inst.Operand2 = &ast.LabelReference{
+			Token: p.curToken,
+			Name:  p.curToken.Literal,
+		}
+		return inst
 	}
 
-	val, err := strconv.Atoi(p.curToken.Literal)
-	if err != nil {
-		return nil
+	// load takes any 32 bit value, the compiler splits it up if it doesn't fit in 16 bits
+	min, max, field := int64(math.MinInt32), int64(math.MaxUint32), "a load immediate"
+	if inst.Opcode.Type == token.LUI {
+		min, max, field = 0, math.MaxUint16, "a lui immediate"
 	}
-	inst.Operand2 = &ast.IntegerLiteral{
-		Token: p.curToken,
-		Value: uint16(val),
+
+	val := p.parseImmediate(min, max, field)
+	if val == nil {
+		return nil
 	}
+	inst.Operand2 = val
 
 	inst.Operand3 = nil
 	return inst
@@ -226,7 +424,7 @@ func (p *Parser) parseRegisterRegisterRegister() ast.Instruction {
 		Value: byte(reg1),
 	}
 
-	if p.registerTooBigError(byte(reg1)) {
+	if p.registerTooBigError(reg1) {
 		return nil
 	}
 
@@ -243,7 +441,7 @@ func (p *Parser) parseRegisterRegisterRegister() ast.Instruction {
 		Value: byte(reg2),
 	}
 
-	if p.registerTooBigError(byte(reg2)) {
+	if p.registerTooBigError(reg2) {
 		return nil
 	}
 
@@ -260,13 +458,149 @@ func (p *Parser) parseRegisterRegisterRegister() ast.Instruction {
 		Value: byte(reg3),
 	}
 
-	if p.registerTooBigError(byte(reg3)) {
+	if p.registerTooBigError(reg3) {
+		return nil
+	}
+
+	return inst
+}
+
+// The opcode an instruction becomes when its second operand is an immediate
+var immediateForms = map[token.TokenType]token.TokenType{
+	token.ADD: token.ADDI,
+	token.SUB: token.SUBI,
+	token.MUL: token.MULI,
+	token.EQ:  token.EQI,
+	token.NEQ: token.NEQI,
+	token.GT:  token.GTI,
+	token.LT:  token.LTI,
+	token.GTE: token.GTEI,
+	token.LTE: token.LTEI,
+}
+
+// add, sub and mul take either a register or an immediate as their second
+// operand. There's no room left for a third register after an immediate, so
+// the result goes back in the first, ie `add $2 #1 $2`.
+func (p *Parser) parseArithmetic() ast.Instruction {
+	inst := &ast.AssemblerInstruction{Opcode: p.curToken}
+
+	src := p.parseRegisterOperand()
+	if src == nil {
+		return nil
+	}
+	inst.Operand1 = src
+
+	if p.peekTokenIs(token.REGISTER) {
+		reg2 := p.parseRegisterOperand()
+		if reg2 == nil {
+			return nil
+		}
+		inst.Operand2 = reg2
+	} else {
+		inst.Opcode.Type = immediateForms[inst.Opcode.Type]
+		if inst.Operand2 = p.parseImmediateOperand(); inst.Operand2 == nil {
+			return nil
+		}
+	}
+
+	dst := p.parseRegisterOperand()
+	if dst == nil {
+		return nil
+	}
+	if _, ok := inst.Operand2.(*ast.RegisterLiteral); !ok && dst.Value != src.Value {
+		p.errorAt(dst.Token, "%s with an immediate puts its result back in $%d, so the last register has to be $%d",
+			inst.Opcode.Literal, src.Value, src.Value)
 		return nil
 	}
+	inst.Operand3 = dst
 
 	return inst
 }
 
+// Compares take either a register or an immediate to compare the first register with
+func (p *Parser) parseCompare() ast.Instruction {
+	inst := &ast.AssemblerInstruction{Opcode: p.curToken}
+
+	reg1 := p.parseRegisterOperand()
+	if reg1 == nil {
+		return nil
+	}
+	inst.Operand1 = reg1
+
+	if p.peekTokenIs(token.REGISTER) {
+		reg2 := p.parseRegisterOperand()
+		if reg2 == nil {
+			return nil
+		}
+		inst.Operand2 = reg2
+		return inst
+	}
+
+	inst.Opcode.Type = immediateForms[inst.Opcode.Type]
+	if inst.Operand2 = p.parseImmediateOperand(); inst.Operand2 == nil {
+		return nil
+	}
+	return inst
+}
+
+func (p *Parser) parseRegisterImmediate() ast.Instruction {
+	inst := &ast.AssemblerInstruction{Opcode: p.curToken}
+
+	reg := p.parseRegisterOperand()
+	if reg == nil {
+		return nil
+	}
+	inst.Operand1 = reg
+
+	if inst.Operand2 = p.parseImmediateOperand(); inst.Operand2 == nil {
+		return nil
+	}
+	return inst
+}
+
+// Moves on to a register operand, returning nil if the next token isn't a valid one
+func (p *Parser) parseRegisterOperand() *ast.RegisterLiteral {
+	if !p.expectPeek(token.REGISTER) {
+		return nil
+	}
+
+	reg, err := strconv.Atoi(p.curToken.Literal)
+	if err != nil {
+		return nil
+	}
+	if p.registerTooBigError(reg) {
+		return nil
+	}
+	return &ast.RegisterLiteral{
+		Token: p.curToken,
+		Value: byte(reg),
+	}
+}
+
+// The immediate operand of an arithmetic or compare instruction, a label
+// reference or a constant that fits in 16 bits
+func (p *Parser) parseImmediateOperand() ast.Expression {
+	if p.peekTokenIs(token.LABEL_REF) {
+		p.nextToken()
+		return &ast.LabelReference{
+			Token: p.curToken,
+			Name:  p.curToken.Literal,
+		}
+	}
+
+	return p.parseImmediate(0, math.MaxUint16, "an immediate operand")
+}
+
+func (p *Parser) parseUnknown() ast.Instruction {
+	p.errorAt(p.curToken, "unknown instruction %q", p.curToken.Literal)
+
+	// Skip the operands so they don't show up as errors of their own
+	for sameLine(p.curToken, p.peekToken) {
+		p.nextToken()
+	}
+	return nil
+}
+
 func (p *Parser) parseBlank() ast.Instruction {
 	inst := &ast.AssemblerInstruction{Opcode: p.curToken}
 
@@ -293,7 +627,7 @@ func (p *Parser) parseRegister() ast.Instruction {
 		Value: uint8(reg),
 	}
 
-	if p.registerTooBigError(byte(reg)) {
+	if p.registerTooBigError(reg) {
 		return nil
 	}
 
@@ -303,6 +637,33 @@ func (p *Parser) parseRegister() ast.Instruction {
 	return inst
 }
 
+func (p *Parser) parseRegisterOrLabel() ast.Instruction {
+	if p.peekTokenIs(token.LABEL_REF) {
+		inst := &ast.AssemblerInstruction{Opcode: p.curToken}
+		p.nextToken()
+		inst.Operand1 = &ast.LabelReference{
+			Token: p.curToken,
+			Name:  p.curToken.Literal,
+		}
+		return inst
+	}
+
+	return p.parseRegister()
+}
+
+func (p *Parser) parseRegisterLabel() ast.Instruction {
+	inst := p.parseRegister()
+	if inst == nil || !p.expectPeek(token.LABEL_REF) {
+		return nil
+	}
+
+	inst.(*ast.AssemblerInstruction).Operand2 = &ast.LabelReference{
+		Token: p.curToken,
+		Name:  p.curToken.Literal,
+	}
+	return inst
+}
+
 func (p *Parser) parseRegisterRegister() ast.Instruction {
 	inst := &ast.AssemblerInstruction{Opcode: p.curToken}
 
@@ -319,7 +680,7 @@ func (p *Parser) parseRegisterRegister() ast.Instruction {
 		Value: uint8(reg1),
 	}
 
-	if p.registerTooBigError(byte(reg1)) {
+	if p.registerTooBigError(reg1) {
 		return nil
 	}
 
@@ -336,7 +697,7 @@ func (p *Parser) parseRegisterRegister() ast.Instruction {
 		Value: uint8(reg2),
 	}
 
-	if p.registerTooBigError(byte(reg2)) {
+	if p.registerTooBigError(reg2) {
 		return nil
 	}
 
@@ -347,4 +708,145 @@ func (p *Parser) parseRegisterRegister() ast.Instruction {
 
 func (p *Parser) parseIgnore() ast.Instruction {
 	return nil
-}
\ No newline at end of file
+}
+
+func (p *Parser) parseLabel() ast.Instruction {
+	return &ast.LabelDeclaration{
+		Token: p.curToken,
+		Name:  p.curToken.Literal,
+	}
+}
+
+// Decodes decimal, 0x hex, 0b binary and 'c' character literals, each optionally negative
+func (p *Parser) parseIntegerLiteral() *ast.IntegerLiteral {
+	val, err := ParseInteger(p.curToken.Literal)
+	if err != nil {
+		p.errorAt(p.curToken, "%s", err)
+		return nil
+	}
+
+	return &ast.IntegerLiteral{
+		Token: p.curToken,
+		Value: val,
+	}
+}
+
+// Works out the value of an integer literal without its `#`: decimal, 0x or 0b
+// prefixed, or a quoted character, optionally negative
+func ParseInteger(lit string) (int64, error) {
+	negative := strings.HasPrefix(lit, "-")
+	digits := strings.TrimPrefix(lit, "-")
+
+	var val int64
+	if strings.HasPrefix(digits, "'") {
+		str, err := strconv.Unquote(digits)
+		if err != nil || utf8.RuneCountInString(str) != 1 {
+			return 0, fmt.Errorf("invalid character literal %s", digits)
+		}
+		r, _ := utf8.DecodeRuneInString(str)
+		val = int64(r)
+	} else {
+		base := 10
+		switch {
+		case strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X"):
+			base, digits = 16, digits[2:]
+		case strings.HasPrefix(digits, "0b") || strings.HasPrefix(digits, "0B"):
+			base, digits = 2, digits[2:]
+		}
+
+		u, err := strconv.ParseUint(digits, base, 64)
+		if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange || u > math.MaxInt64 {
+			return 0, fmt.Errorf("integer literal %s is too big", lit)
+		} else if err != nil {
+			return 0, fmt.Errorf("invalid integer literal %s", lit)
+		}
+		val = int64(u)
+	}
+
+	if negative {
+		val = -val
+	}
+	return val, nil
+}
+
+func (p *Parser) parseSection() ast.Instruction {
+	return &ast.SectionDirective{Token: p.curToken}
+}
+
+func (p *Parser) parseDataValues() ast.Instruction {
+	inst := &ast.DataDirective{Token: p.curToken}
+
+	for {
+		if p.curTokenIs(token.WORD) && p.peekTokenIs(token.LABEL_REF) {
+			p.nextToken()
+			inst.Values = append(inst.Values, &ast.LabelReference{
+				Token: p.curToken,
+				Name:  p.curToken.Literal,
+			})
+		} else {
+			min, max, field := int64(math.MinInt8), int64(math.MaxUint8), "a byte"
+			if inst.Token.Type == token.WORD {
+				min, max, field = math.MinInt32, math.MaxUint32, "a word"
+			}
+			val := p.parseImmediate(min, max, field)
+			if val == nil {
+				return nil
+			}
+			inst.Values = append(inst.Values, val)
+		}
+
+		if !p.peekTokenIs(token.COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+
+	return inst
+}
+
+func (p *Parser) parseString() ast.Instruction {
+	inst := &ast.DataDirective{Token: p.curToken}
+
+	if !p.expectPeek(token.STRING) {
+		return nil
+	}
+
+	str, err := strconv.Unquote(`"` + p.curToken.Literal + `"`)
+	if err != nil {
+		p.errorAt(p.curToken, "invalid string literal %q: %s", p.curToken.Literal, err)
+		return nil
+	}
+	inst.Values = []ast.Expression{&ast.StringLiteral{
+		Token: p.curToken,
+		Value: str,
+	}}
+
+	return inst
+}
+
+func (p *Parser) parseSpace() ast.Instruction {
+	inst := &ast.DataDirective{Token: p.curToken}
+
+	val := p.parseImmediate(0, math.MaxUint16, "a .space size")
+	if val == nil {
+		return nil
+	}
+	inst.Values = []ast.Expression{val}
+
+	return inst
+}
+
+func (p *Parser) parseEntry() ast.Instruction {
+	inst := &ast.EntryDirective{Token: p.curToken}
+
+	if !p.expectPeek(token.LABEL_REF) {
+		return nil
+	}
+
+	inst.Label = &ast.LabelReference{
+		Token: p.curToken,
+		Name:  p.curToken.Literal,
+	}
+
+	return inst
+}
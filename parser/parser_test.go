@@ -136,6 +136,227 @@ func TestJmpOpcode(t *testing.T) {
 	if !testNil(t, inst.Operand3, true) { return }
 }
 
+func TestLabels(t *testing.T) {
+	input := `start:
+load $31 @start`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Instructions) != 2 {
+		t.Fatalf("program.Instructions does not contain %d statements. got=%d\n",
+			2, len(program.Instructions))
+	}
+
+	label, ok := program.Instructions[0].(*ast.LabelDeclaration)
+	if !ok {
+		t.Fatalf("inst is not ast.LabelDeclaration. got=%T",
+			program.Instructions[0])
+	}
+
+	if label.Name != "start" {
+		t.Fatalf("label.Name is not %q. got=%q", "start", label.Name)
+	}
+
+	inst, ok := program.Instructions[1].(*ast.AssemblerInstruction)
+	if !ok {
+		t.Fatalf("inst is not ast.AssemblerInstruction. got=%T",
+			program.Instructions[1])
+	}
+
+	if !testRegister(t, inst.Operand1, 31) { return }
+
+	ref, ok := inst.Operand2.(*ast.LabelReference)
+	if !ok {
+		t.Fatalf("inst.Operand2 is not ast.LabelReference. got=%T",
+			inst.Operand2)
+	}
+
+	if ref.Name != "start" {
+		t.Fatalf("ref.Name is not %q. got=%q", "start", ref.Name)
+	}
+}
+
+func TestDataDirectives(t *testing.T) {
+	input := `.data
+.byte #1, #2, #255
+.asciiz "a\tb"`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Instructions) != 3 {
+		t.Fatalf("program.Instructions does not contain %d statements. got=%d\n",
+			3, len(program.Instructions))
+	}
+
+	if _, ok := program.Instructions[0].(*ast.SectionDirective); !ok {
+		t.Fatalf("inst is not ast.SectionDirective. got=%T",
+			program.Instructions[0])
+	}
+
+	bytes, ok := program.Instructions[1].(*ast.DataDirective)
+	if !ok {
+		t.Fatalf("inst is not ast.DataDirective. got=%T",
+			program.Instructions[1])
+	}
+
+	if len(bytes.Values) != 3 {
+		t.Fatalf("bytes.Values does not contain %d values. got=%d",
+			3, len(bytes.Values))
+	}
+
+	if !testInteger(t, bytes.Values[2], 255) { return }
+
+	str, ok := program.Instructions[2].(*ast.DataDirective)
+	if !ok {
+		t.Fatalf("inst is not ast.DataDirective. got=%T",
+			program.Instructions[2])
+	}
+
+	lit, ok := str.Values[0].(*ast.StringLiteral)
+	if !ok {
+		t.Fatalf("str.Values[0] is not ast.StringLiteral. got=%T",
+			str.Values[0])
+	}
+
+	if lit.Value != "a\tb" {
+		t.Fatalf("lit.Value is not %q. got=%q", "a\tb", lit.Value)
+	}
+}
+
+func TestByteTooBig(t *testing.T) {
+	l := lexer.New(".data\n.byte #256")
+	p := New(l)
+	p.ParseProgram()
+
+	if len(p.Errors()) != 1 {
+		t.Fatalf("expected 1 parser error. got=%d", len(p.Errors()))
+	}
+}
+
+func TestRegisterTooBig(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"load $257 #7", "register number too big, must be less than 32. got=257"},
+		{"load $300 #7", "register number too big, must be less than 32. got=300"},
+		{"push $256", "register number too big, must be less than 32. got=256"},
+		{"not $1 $288", "register number too big, must be less than 32. got=288"},
+		{"and $1 $2 $259", "register number too big, must be less than 32. got=259"},
+		{"add $1 $2 $300", "register number too big, must be less than 32. got=300"},
+		{"eq $260 $1", "register number too big, must be less than 32. got=260"},
+		{"addi $256 #1", "register number too big, must be less than 32. got=256"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected an error for %q, got none", tt.input)
+			continue
+		}
+
+		if p.Errors()[0].Message != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot =%q",
+				tt.input, tt.expected, p.Errors()[0].Message)
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	l := lexer.New("hlt\n  load #1 $2")
+	p := New(l)
+	p.ParseProgram()
+
+	if len(p.Errors()) == 0 {
+		t.Fatalf("expected parser errors, got none")
+	}
+
+	d := p.Errors()[0]
+	if d.Span.Start.Line != 2 || d.Span.Start.Column != 8 || d.Span.End.Column != 10 {
+		t.Errorf("wrong span. want=2:8-10, got=%d:%d-%d",
+			d.Span.Start.Line, d.Span.Start.Column, d.Span.End.Column)
+	}
+}
+
+func TestIntegerLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"#42", 42},
+		{"#007", 7},
+		{"#-1", -1},
+		{"#0xFF", 255},
+		{"#0Xff", 255},
+		{"#-0x80", -128},
+		{"#0b1010", 10},
+		{"#'A'", 65},
+		{`#'\n'`, 10},
+		{`#'\''`, 39},
+		{"#4294967295", 4294967295},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(".data\n.word " + tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		word := program.Instructions[1].(*ast.DataDirective)
+		lit, ok := word.Values[0].(*ast.IntegerLiteral)
+		if !ok {
+			t.Fatalf("value is not ast.IntegerLiteral. got=%T", word.Values[0])
+		}
+
+		if lit.Value != tt.expected {
+			t.Errorf("wrong value for %s. want=%d, got=%d", tt.input, tt.expected, lit.Value)
+		}
+	}
+}
+
+func TestIntegerLiteralErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"load $0 #-2147483649", "value -2147483649 does not fit in a load immediate, must be between -2147483648 and 4294967295"},
+		{"load $0 #0x100000000", "value 4294967296 does not fit in a load immediate, must be between -2147483648 and 4294967295"},
+		{"lui $0 #65536", "value 65536 does not fit in a lui immediate, must be between 0 and 65535"},
+		{".data\n.byte #-129", "value -129 does not fit in a byte, must be between -128 and 255"},
+		{".data\n.word #0x100000000", "value 4294967296 does not fit in a word, must be between -2147483648 and 4294967295"},
+		{".data\n.space #-1", "value -1 does not fit in a .space size, must be between 0 and 65535"},
+		{"load $0 #0x", "invalid integer literal 0x"},
+		{"load $0 #12ab", "invalid integer literal 12ab"},
+		{"load $0 #99999999999999999999", "integer literal 99999999999999999999 is too big"},
+		{"load $0 #'AB'", "invalid character literal 'AB'"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected an error for %q, got none", tt.input)
+			continue
+		}
+
+		if p.Errors()[0].Message != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot =%q",
+				tt.input, tt.expected, p.Errors()[0].Message)
+		}
+	}
+}
+
 func testRegister(t *testing.T, exp ast.Expression, value uint8) bool {
 	reg, ok := exp.(*ast.RegisterLiteral)
 	if !ok {
@@ -157,7 +378,7 @@ func testRegister(t *testing.T, exp ast.Expression, value uint8) bool {
 	return true
 }
 
-func testInteger(t *testing.T, exp ast.Expression, value uint16) bool {
+func testInteger(t *testing.T, exp ast.Expression, value int64) bool {
 	int, ok := exp.(*ast.IntegerLiteral)
 	if !ok {
 		t.Errorf("exp not *ast.IntegerLiteral. got=%T", exp)
@@ -193,8 +414,160 @@ func checkParserErrors(t *testing.T, p *Parser) {
 	}
 
 	t.Errorf("parser has %d errors", len(errors))
-	for _, msg := range errors {
-		t.Errorf("parser error: %q", msg)
+	for _, d := range errors {
+		t.Errorf("parser error: %s", d)
 	}
 	t.FailNow()
 }
+
+func TestConstantExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"load $1 #(1 + 2 * 3)", "load $1 (#1 + (#2 * #3));"},
+		{"load $1 #((1 + 2) * 3)", "load $1 ((#1 + #2) * #3);"},
+		{"load $1 #(1 | 2 & 3 << 4 + 5)", "load $1 (#1 | (#2 & (#3 << (#4 + #5))));"},
+		{"load $1 #(8 - 4 - 2)", "load $1 ((#8 - #4) - #2);"},
+		{"load $1 #(-@end % 4)", "load $1 ((-@end) % #4);"},
+		{"load $1 #(SIZE >> 1)", "load $1 (#16 >> #1);"},
+		{"lui $1 #HIGH(@end + 'A')", "lui $1 HIGH((@end + #'A'));"},
+		{"load $1 #low(0x1234)", "load $1 LOW(#0x1234);"},
+		{".data\n.byte #(1 + 1), #2", ".data.byte (#1 + #1), #2;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := NewWithOptions(l, Options{Defines: map[string]int64{"SIZE": 16}})
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong program for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestConstantExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"load $1 #(1 +)", "unexpected ) in expression"},
+		{"load $1 #(1 + 2", "expected next token to be ), got EOF instead"},
+		{"load $1 #MID(1)", `unknown function "MID", expected HIGH or LOW`},
+		{"load $1 #($2)", "unexpected REGISTER in expression"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected an error for %q, got none", tt.input)
+			continue
+		}
+
+		if p.Errors()[0].Message != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot =%q",
+				tt.input, tt.expected, p.Errors()[0].Message)
+		}
+	}
+}
+
+func TestImmediateOperands(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected token.TokenType
+	}{
+		{"add $2 $1 $2", token.ADD},
+		{"add $2 #1 $2", token.ADDI},
+		{"sub $2 #1 $2", token.SUBI},
+		{"mul $2 #4 $2", token.MULI},
+		{"eq $0 $1", token.EQ},
+		{"eq $0 #65535", token.EQI},
+		{"neq $0 #1", token.NEQI},
+		{"gt $0 #1", token.GTI},
+		{"lt $0 @end", token.LTI},
+		{"gte $0 #1", token.GTEI},
+		{"lte $0 #1", token.LTEI},
+		{"addi $2 #1", token.ADDI},
+		{"cmpi $0 #65535", token.CMPI},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		inst, ok := program.Instructions[0].(*ast.AssemblerInstruction)
+		if !ok {
+			t.Fatalf("inst is not ast.AssemblerInstruction. got=%T", program.Instructions[0])
+		}
+		if inst.Opcode.Type != tt.expected {
+			t.Errorf("wrong opcode for %q. want=%q, got=%q", tt.input, tt.expected, inst.Opcode.Type)
+		}
+		// The source is kept as written
+		if program.String() != tt.input+";" {
+			t.Errorf("wrong program for %q. got=%q", tt.input, program.String())
+		}
+	}
+
+	errors := []struct {
+		input    string
+		expected string
+	}{
+		{"add $2 #1 $3", "add with an immediate puts its result back in $2, so the last register has to be $2"},
+		{"add $2 #1", "expected next token to be REGISTER, got EOF instead"},
+		{"sub $2 #65536 $2", "value 65536 does not fit in an immediate operand, must be between 0 and 65535"},
+		{"eq $0 #-1", "value -1 does not fit in an immediate operand, must be between 0 and 65535"},
+		{"addi $2 $1", "expected next token to be INT, got REGISTER instead"},
+	}
+
+	for _, tt := range errors {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected an error for %q, got none", tt.input)
+			continue
+		}
+
+		if p.Errors()[0].Message != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot =%q",
+				tt.input, tt.expected, p.Errors()[0].Message)
+		}
+	}
+}
+
+func TestPseudoInstructions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"mov $1 $2", "mov $1 $2;"},
+		{"inc $1\ndec $2\nclr $3", "inc $1;dec $2;clr $3;"},
+		{"jmpz $4 @done", "jmpz $4 @done;"},
+		{"jmp @done\njmp $5", "jmp @done;jmp $5;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong program for %q.\nwant=%q\ngot =%q", tt.input, tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("jmpz $1 $2"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 {
+		t.Errorf("expected an error for jmpz without a label")
+	}
+}
@@ -0,0 +1,212 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"simpsel/diag"
+	"simpsel/lexer"
+	"simpsel/token"
+	"strings"
+)
+
+// Sits between the lexer and the parser. It records macro definitions,
+// replaces every macro call with the macro's body and reads included files
+// in place, so the parser only ever sees plain instructions.
+type preprocessor struct {
+	frames  []*frame
+	errorAt func(tok token.Token, format string, a ...interface{})
+
+	macros       map[string]*macro
+	expansions   int                  // Number of expansions so far, keeps local labels unique
+	includePaths []string             // Directories searched for included files
+	noIncludes   bool                 // Whether .include is rejected
+	sources      diag.Sources         // Text of every file read so far
+	constants    map[string]*constant // Values for #NAME operands
+	conditions   []*condition         // The .if blocks we're inside, innermost last
+}
+
+// Somewhere tokens are read from: a file, or the body of a macro being expanded
+type frame struct {
+	l      *lexer.Lexer  // nil for a macro expansion
+	path   string        // Absolute path of the file l reads, used to spot include cycles
+	tokens []token.Token // Expanded tokens, or tokens peeked from l
+}
+
+func newPreprocessor(l *lexer.Lexer, opts Options, errorAt func(token.Token, string, ...interface{})) *preprocessor {
+	root := &frame{l: l}
+	if l.File() != "" {
+		root.path, _ = filepath.Abs(l.File())
+	}
+
+	constants := make(map[string]*constant)
+	for name, value := range opts.Defines {
+		constants[name] = &constant{value: value}
+	}
+
+	return &preprocessor{
+		frames:       []*frame{root},
+		errorAt:      errorAt,
+		macros:       make(map[string]*macro),
+		includePaths: opts.IncludePaths,
+		noIncludes:   opts.NoIncludes,
+		sources:      diag.Sources{l.File(): l.Input()},
+		constants:    constants,
+	}
+}
+
+func (pp *preprocessor) NextToken() token.Token {
+	for {
+		tok := pp.read()
+		if pp.conditional(tok) || pp.skipping() {
+			continue
+		}
+
+		switch tok.Type {
+		case token.EQU:
+			pp.defineConstant(tok)
+		case token.CONST:
+			return pp.substitute(tok)
+		case token.MACRO:
+			pp.define(tok)
+		case token.ENDM:
+			pp.errorAt(tok, ".endm without a .macro")
+		case token.INCLUDE:
+			pp.include(tok)
+		case token.IDENT:
+			if m, ok := pp.macros[tok.Literal]; ok {
+				pp.expand(tok, m)
+				continue
+			}
+			return tok
+		default:
+			return tok
+		}
+	}
+}
+
+// Reads the next token from the innermost frame, dropping frames as they run
+// out. Only the outermost file ever hands out EOF.
+func (pp *preprocessor) read() token.Token {
+	for {
+		f := pp.frames[len(pp.frames)-1]
+		if len(f.tokens) > 0 {
+			tok := f.tokens[0]
+			f.tokens = f.tokens[1:]
+			return tok
+		}
+		if f.l != nil {
+			tok := f.l.NextToken()
+			if tok.Type != token.EOF || len(pp.frames) == 1 {
+				return tok
+			}
+		}
+		pp.frames = pp.frames[:len(pp.frames)-1]
+	}
+}
+
+// Puts tok back so the next read returns it
+func (pp *preprocessor) unread(tok token.Token) {
+	f := pp.frames[len(pp.frames)-1]
+	f.tokens = append([]token.Token{tok}, f.tokens...)
+}
+
+func (pp *preprocessor) peek() token.Token {
+	tok := pp.read()
+	pp.unread(tok)
+	return tok
+}
+
+// Reads the operands following start on its line, skipping the commas between them
+func (pp *preprocessor) readLine(start token.Token) []token.Token {
+	tokens := []token.Token{}
+	for {
+		tok := pp.peek()
+		if !sameLine(start, tok) || tok.Type == token.COMMENT {
+			return tokens
+		}
+		pp.read()
+		if tok.Type != token.COMMA {
+			tokens = append(tokens, tok)
+		}
+	}
+}
+
+// Reads the file named by an .include and carries on with its tokens
+func (pp *preprocessor) include(directive token.Token) {
+	name := pp.read()
+	if !sameLine(directive, name) || name.Type != token.STRING {
+		pp.unread(name)
+		pp.errorAt(directive, ".include needs a file name in quotes")
+		return
+	}
+	if pp.noIncludes {
+		pp.errorAt(directive, ".include isn't allowed here")
+		return
+	}
+
+	file, ok := pp.findInclude(directive.File, name.Literal)
+	if !ok {
+		pp.errorAt(name, "can't find included file %q", name.Literal)
+		return
+	}
+
+	path, err := filepath.Abs(file)
+	if err != nil {
+		pp.errorAt(name, "can't include %q: %s", name.Literal, err)
+		return
+	}
+	for i, f := range pp.frames {
+		if f.path == path {
+			pp.errorAt(name, "include cycle: %s", pp.includeChain(i, file))
+			return
+		}
+	}
+
+	input, err := ioutil.ReadFile(file)
+	if err != nil {
+		pp.errorAt(name, "can't include %q: %s", name.Literal, err)
+		return
+	}
+
+	pp.sources[file] = string(input)
+	pp.frames = append(pp.frames, &frame{l: lexer.NewFile(file, string(input)), path: path})
+}
+
+// Looks for name next to the including file first, then in each include path
+func (pp *preprocessor) findInclude(from string, name string) (string, bool) {
+	if filepath.IsAbs(name) {
+		return name, fileExists(name)
+	}
+
+	dirs := append([]string{filepath.Dir(from)}, pp.includePaths...)
+	for _, dir := range dirs {
+		file := filepath.Join(dir, name)
+		if fileExists(file) {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// Describes the files that lead from frame start back round to file
+func (pp *preprocessor) includeChain(start int, file string) string {
+	chain := []string{}
+	for _, f := range pp.frames[start:] {
+		if f.l != nil {
+			chain = append(chain, f.l.File())
+		}
+	}
+	return strings.Join(append(chain, file), " -> ")
+}
+
+func fileExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
+
+// Whether b is on the same line as a. Tokens from different expansions are
+// never on the same line, even if they came from the same line of a macro.
+func sameLine(a, b token.Token) bool {
+	return b.Type != token.EOF && a.Line == b.Line && a.File == b.File && a.From == b.From
+}
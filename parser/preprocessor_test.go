@@ -0,0 +1,131 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"simpsel/lexer"
+	"testing"
+)
+
+// Writes each file into a new temporary directory, which the caller removes
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "simpsel")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("can't create %s: %s", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("can't write %s: %s", path, err)
+		}
+	}
+	return dir
+}
+
+func parseFile(t *testing.T, path string, includePaths ...string) *Parser {
+	t.Helper()
+
+	input, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("can't read %s: %s", path, err)
+	}
+	return NewWithOptions(lexer.NewFile(path, string(input)), Options{IncludePaths: includePaths})
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.sasm":     ".include \"inc/regs.sasm\"\nsetup\n.include \"math.sasm\"\nhlt",
+		"inc/regs.sasm": ".macro setup\nload $1 #1\n.endm",
+		"lib/math.sasm": "double:\nadd $1 $1 $1\nret",
+	})
+	defer os.RemoveAll(dir)
+
+	p := parseFile(t, filepath.Join(dir, "main.sasm"), filepath.Join(dir, "lib"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	expected := "load $1 #1;double:add $1 $1 $1;ret;hlt;"
+	if program.String() != expected {
+		t.Errorf("wrong program.\nwant=%q\ngot =%q", expected, program.String())
+	}
+
+	if len(p.Sources()) != 3 {
+		t.Errorf("expected 3 sources. got=%d", len(p.Sources()))
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"self.sasm":    ".include \"self.sasm\"",
+		"a.sasm":       ".include \"b.sasm\"",
+		"b.sasm":       "nop\n.include \"a.sasm\"",
+		"missing.sasm": ".include \"nowhere.sasm\"",
+		"bare.sasm":    ".include\nhlt",
+		"bad.sasm":     ".include \"bad_inc.sasm\"",
+		"bad_inc.sasm": "nop\nload #1 $1",
+	})
+	defer os.RemoveAll(dir)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"self.sasm", "include cycle: " + path("self.sasm") + " -> " + path("self.sasm")},
+		{"a.sasm", "include cycle: " + path("a.sasm") + " -> " + path("b.sasm") + " -> " + path("a.sasm")},
+		{"missing.sasm", `can't find included file "nowhere.sasm"`},
+		{"bare.sasm", ".include needs a file name in quotes"},
+	}
+
+	for _, tt := range tests {
+		p := parseFile(t, path(tt.file))
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected an error for %s, got none", tt.file)
+			continue
+		}
+
+		if p.Errors()[0].Message != tt.expected {
+			t.Errorf("wrong error for %s.\nwant=%q\ngot =%q", tt.file, tt.expected, p.Errors()[0].Message)
+		}
+	}
+
+	// Errors in an included file are reported against that file
+	p := parseFile(t, path("bad.sasm"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 {
+		t.Fatalf("expected an error for bad.sasm, got none")
+	}
+	expected := path("bad_inc.sasm") + ":2:6: error: expected next token to be REGISTER, got INT instead"
+	if p.Errors()[0].Error() != expected {
+		t.Errorf("wrong error.\nwant=%q\ngot =%q", expected, p.Errors()[0].Error())
+	}
+}
+
+func TestNoIncludes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"secret.sasm": "load $1 #1"})
+	defer os.RemoveAll(dir)
+
+	input := "nop .include \"" + filepath.Join(dir, "secret.sasm") + "\"\nhlt"
+	p := NewWithOptions(lexer.New(input), Options{NoIncludes: true})
+	p.ParseProgram()
+
+	if len(p.Errors()) == 0 {
+		t.Fatalf("expected an error for .include, got none")
+	}
+	if p.Errors()[0].Message != ".include isn't allowed here" {
+		t.Errorf("wrong error. got=%q", p.Errors()[0].Message)
+	}
+	// The file mustn't be read, or it could end up in an error message
+	if len(p.Sources()) != 1 {
+		t.Errorf("expected only the input in the sources. got=%d", len(p.Sources()))
+	}
+}
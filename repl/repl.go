@@ -3,6 +3,7 @@ package repl
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/gliderlabs/ssh"
 	"golang.org/x/crypto/ssh/terminal"
@@ -11,19 +12,62 @@ import (
 	"os"
 	"simpsel/code"
 	"simpsel/compiler"
+	"simpsel/diag"
 	"simpsel/lexer"
 	"simpsel/parser"
 	"simpsel/vm"
 	"strings"
+	"time"
 )
 
 const PROMPT = ">>> "
 
-func Start(in io.Reader, out io.Writer) {
-	run := true
+// Limits applied to every run started from a session
+type Limits struct {
+	MaxInstructions int           // 0 for no limit
+	Timeout         time.Duration // 0 for no timeout
+}
+
+var (
+	// Local sessions get a generous timeout so a runaway loop can't hang the REPL
+	LocalLimits = Limits{MaxInstructions: 0, Timeout: 30 * time.Second}
+	// SSH sessions share the server, so one runaway loop mustn't hog it
+	SSHLimits = Limits{MaxInstructions: 10000000, Timeout: 5 * time.Second}
+)
+
+// The state kept for each REPL user
+type session struct {
+	machine *vm.VM
+	run     bool
+	limits  Limits
+	ctx     context.Context
+	files   bool  // Whether input can read files on this machine, with .load_file or .include
+	scratch uint8 // The register pseudo-instructions may clobber
+}
+
+func newSession(ctx context.Context, limits Limits, files bool, scratch uint8) *session {
+	return &session{
+		machine: vm.New(&compiler.Bytecode{Instructions: []byte{}}),
+		run:     true,
+		limits:  limits,
+		ctx:     ctx,
+		files:   files,
+		scratch: scratch,
+	}
+}
+
+func (s *session) runOptions() vm.RunOptions {
+	opts := vm.RunOptions{MaxInstructions: s.limits.MaxInstructions, Context: s.ctx}
+	if s.limits.Timeout > 0 {
+		opts.Deadline = time.Now().Add(s.limits.Timeout)
+	}
+	return opts
+}
+
+func Start(in io.Reader, out io.Writer, scratch uint8) {
 	closed := false
 	scanner := bufio.NewScanner(in)
-	machine := vm.New(&compiler.Bytecode{Instructions: []byte{}})
+	sess := newSession(context.Background(), LocalLimits, true, scratch)
 	fmt.Fprint(out, "Welcome to simpsel. Let's be productive!\n\n")
 
 	for {
@@ -34,17 +78,17 @@ func Start(in io.Reader, out io.Writer) {
 		}
 
 		line := scanner.Text()
-		run, closed = handleInput(out, line, machine, run)
+		closed = sess.handleInput(out, line)
 		if closed {
 			os.Exit(1)
 		}
 	}
 }
 
-func StartTerminal(s ssh.Session, term *terminal.Terminal) {
-	run := true
+func StartTerminal(s ssh.Session, term *terminal.Terminal, scratch uint8) {
 	closed := false
-	machine := vm.New(&compiler.Bytecode{Instructions: []byte{}})
+	// Anyone who can connect could otherwise read the server's files
+	sess := newSession(s.Context(), SSHLimits, false, scratch)
 	term.Write([]byte("Welcome to simpsel. Let's be productive!\n\n"))
 
 	for closed != true {
@@ -61,7 +105,7 @@ func StartTerminal(s ssh.Session, term *terminal.Terminal) {
 			return
 		}
 		out := bytes.NewBuffer([]byte{})
-		run, closed = handleInput(out, line, machine, run)
+		closed = sess.handleInput(out, line)
 		term.Write(out.Bytes())
 		if closed {
 			s.Close()
@@ -70,89 +114,150 @@ func StartTerminal(s ssh.Session, term *terminal.Terminal) {
 	}
 }
 
-func handleInput(out io.Writer, input string, machine *vm.VM, run bool) (runO, close bool){
+func (s *session) handleInput(out io.Writer, input string) (close bool) {
+	machine := s.machine
 	switch input {
 	case ".clear_registers":
 		machine.Registers = make([]int32, 32)
+		machine.Flags = 0
 		fmt.Fprint(out, "Registers cleared\n")
 	case ".registers":
-		fmt.Fprintf(out, "%v\n", machine.Registers)
+		fmt.Fprintf(out, "%v\nFlags: %s\n", machine.Registers, machine.Flags)
 	case ".clear_program":
 		machine.Program = code.Instructions{}
+		machine.SourceMap = nil
 		fmt.Fprint(out, "Program cleared\n")
 	case ".program":
 		fmt.Fprintf(out, "BEGIN PROGRAM LISTING\n%v\nEND PROGRAM LISTING\n", machine.Program)
+	case ".disasm":
+		listing, err := code.Disassemble(machine.Program)
+		if err != nil {
+			fmt.Fprintf(out, "Can't disassemble the program: %s\n", err)
+			return false
+		}
+		fmt.Fprintf(out, "BEGIN DISASSEMBLY\n%sEND DISASSEMBLY\n", listing)
+	case ".stack":
+		fmt.Fprintf(out, "SP: %d\n%v\n", machine.SP, machine.Stack[:machine.SP])
+	case ".memory":
+		fmt.Fprintf(out, "BEGIN MEMORY LISTING\n%v\nEND MEMORY LISTING\n", machine.Memory)
 	case ".pc":
-		fmt.Fprintf(out, "%d\n", machine.Counter)
+		if source := machine.Source(machine.Counter); source != "" {
+			fmt.Fprintf(out, "%d %s\n", machine.Counter, source)
+		} else {
+			fmt.Fprintf(out, "%d\n", machine.Counter)
+		}
 	case ".rpc":
 		fmt.Fprint(out, "Counter reset\n")
 		machine.Counter = 0
 	case ".run":
-		machine.Run(out)
+		PrintResult(out, machine.RunWithOptions(out, s.runOptions()))
 	case ".run_once":
-		machine.RunOnce(out)
+		PrintFault(out, machine.RunOnce(out))
 	case ".tr":
-		runO = !run
-		fmt.Fprintf(out, "Running? %t\n", runO)
-		return runO, false
+		s.run = !s.run
+		fmt.Fprintf(out, "Running? %t\n", s.run)
+		return false
 	case ".quit":
 		fmt.Fprint(out, "Goodbye!\n")
-		return run, true
+		return true
 
 	default:
+		name := "" // Typed in lines don't come from a file
 		if strings.HasPrefix(input, ".load_file") {
+			if !s.files {
+				fmt.Fprint(out, "Loading files isn't allowed here\n")
+				return false
+			}
 			inArr := strings.Split(input, " ")
 			if len(inArr) < 2 {
 				fmt.Fprintf(out, "You must provide a file to load!")
-				return run, false
+				return false
 			}
 			fi, err := os.Stat(inArr[1])
 			if err != nil {
 				fmt.Fprintf(out, "Invalid file!")
-				return run, false
+				return false
 			}
 			if fi.IsDir() {
 				fmt.Fprintf(out, "You can't load a directory!")
-				return run, false
+				return false
 			}
 			file, _ := os.Open(inArr[1])
 			inputb, err := ioutil.ReadAll(file)
 			if err != nil {
 				fmt.Fprintf(out, "An error occured trying to load the file! %s", err)
-				return run, false
+				return false
 			}
 			input = string(inputb)
+			name = inArr[1]
 		} else if strings.HasPrefix(input, ".") {
 			fmt.Fprintf(out, "Unknown command %s\n", input)
-			return run, false
+			return false
 		}
-		l := lexer.New(input)
-		p := parser.New(l)
+		l := lexer.NewFile(name, input)
+		p := parser.NewWithOptions(l, parser.Options{NoIncludes: !s.files})
 
 		program := p.ParseProgram()
 		if len(p.Errors()) != 0 {
-			PrintParserErrors(out, p.Errors())
-			return run, false
+			PrintParserErrors(out, p.Sources(), p.Errors())
+			return false
 		}
 
-		comp := compiler.New()
+		// The code and data go after what's already loaded, so labels have to count from there
+		comp := compiler.NewWithOptions(compiler.Options{
+			ScratchRegister: s.scratch,
+			CodeBase:        len(machine.Program),
+			DataBase:        len(machine.Memory),
+		})
 		err := comp.Compile(program)
 		if err != nil {
-			fmt.Fprintf(out, "Woophs! Compilation failed:\n %s\n", err)
-			return run, false
+			PrintCompileError(out, p.Sources(), err)
+			return false
 		}
 
+		// Typed in lines are all line 1, so only loaded files are worth mapping
+		for _, line := range comp.Bytecode().SourceMap {
+			if line.File != "" {
+				line.Offset += len(machine.Program)
+				machine.SourceMap = append(machine.SourceMap, line)
+			}
+		}
 		machine.Program = append(machine.Program, comp.Bytecode().Instructions...)
-		if run {
-			machine.RunOnce(out)
+		machine.Memory = append(machine.Memory, comp.Bytecode().Data...)
+		if s.run {
+			PrintFault(out, machine.RunOnce(out))
 		}
 	}
-	return run, false
+	return false
 }
 
-func PrintParserErrors(out io.Writer, errors []string) {
+func PrintParserErrors(out io.Writer, sources diag.Sources, errors []*diag.Diagnostic) {
 	io.WriteString(out, " parser errors:\n")
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+	diag.RenderAll(out, sources, errors)
+}
+
+func PrintCompileError(out io.Writer, sources diag.Sources, err error) {
+	io.WriteString(out, "Woophs! Compilation failed:\n")
+	if d, ok := err.(*diag.Diagnostic); ok {
+		diag.Render(out, sources, d)
+		return
 	}
-}
\ No newline at end of file
+	fmt.Fprintf(out, " %s\n", err)
+}
+
+func PrintFault(out io.Writer, err error) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(out, "Fault! %s\n", err)
+}
+
+// Reports why a run stopped, if it didn't stop by itself
+func PrintResult(out io.Writer, result vm.Result) {
+	switch result.Reason {
+	case vm.Faulted:
+		PrintFault(out, result.Err)
+	case vm.BudgetExhausted, vm.DeadlineExceeded, vm.Canceled:
+		fmt.Fprintf(out, "Stopped: %s\n", result)
+	}
+}
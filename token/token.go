@@ -1,5 +1,7 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 const (
@@ -11,13 +13,57 @@ const (
 	// Identifiers & Literals
 	INT      = "INT"      // #10, #2, #30
 	REGISTER = "REGISTER" // $10, $1, $0
+	STRING   = "STRING"   // "Hello, World!"
+	CONST    = "CONST"    // #SIZE, replaced by its value before parsing
+	FUNCTION = "FUNCTION" // #HIGH(@label), #LOW(@label)
+
+	// Labels
+	LABEL     = "LABEL"     // loop:
+	LABEL_REF = "LABEL_REF" // @loop
+
+	// Delimiters
+	COMMA = ","
+
+	// Constant expressions, ie #(SIZE*4+1)
+	LPAREN    = "("
+	RPAREN    = ")"
+	PLUS      = "+"
+	MINUS     = "-"
+	ASTERISK  = "*"
+	SLASH     = "/"
+	PERCENT   = "%"
+	AMPERSAND = "&"
+	PIPE      = "|"
+	LSHIFT    = "<<"
+	RSHIFT    = ">>"
 
 	// Directives
-	CODE = "CODE"
-	DATA = "DATA"
+	CODE   = "CODE"
+	DATA   = "DATA"
+	BYTE   = "BYTE"
+	WORD   = "WORD"
+	ASCIIZ = "ASCIIZ"
+	SPACE  = "SPACE"
+	ENTRY  = "ENTRY"
+
+	// Include directive, handled before the parser sees it
+	INCLUDE = "INCLUDE"
+
+	// Constants and conditional assembly, handled before the parser sees them
+	EQU    = "EQU"
+	IF     = "IF"
+	IFDEF  = "IFDEF"
+	IFNDEF = "IFNDEF"
+	ELSE   = "ELSE"
+	ENDIF  = "ENDIF"
+
+	// Macro directives, handled before the parser sees them
+	MACRO = "MACRO"
+	ENDM  = "ENDM"
 
 	// Opcodes
 	LOAD = "LOAD"
+	LUI  = "LUI"
 	ADD  = "ADD"
 	SUB  = "SUB"
 	MUL  = "MUL"
@@ -34,16 +80,112 @@ const (
 	LTE  = "LTE"
 	JMPE = "JMPE"
 	NOP  = "NOP"
+
+	// Bitwise opcodes
+	AND = "AND"
+	OR  = "OR"
+	XOR = "XOR"
+	NOT = "NOT"
+	SHL = "SHL"
+	SHR = "SHR"
+	SAR = "SAR"
+
+	// Opcodes reading the remainder and the equal flag
+	MOD    = "MOD"
+	REM    = "REM"
+	SETEQ  = "SETEQ"
+	SETNEQ = "SETNEQ"
+	SETGT  = "SETGT"
+	SETLT  = "SETLT"
+	SETGTE = "SETGTE"
+	SETLTE = "SETLTE"
+	JMPNE  = "JMPNE"
+
+	// Jumps on the status flags
+	JZ  = "JZ"
+	JNZ = "JNZ"
+	JN  = "JN"
+	JNN = "JNN"
+	JC  = "JC"
+	JNC = "JNC"
+	JO  = "JO"
+	JNO = "JNO"
+
+	// Opcodes taking an immediate in place of their second register
+	ADDI = "ADDI"
+	SUBI = "SUBI"
+	MULI = "MULI"
+	EQI  = "EQI"
+	NEQI = "NEQI"
+	GTI  = "GTI"
+	LTI  = "LTI"
+	GTEI = "GTEI"
+	LTEI = "LTEI"
+	CMPI = "CMPI"
+
+	// Memory opcodes
+	LB    = "LB"
+	LW    = "LW"
+	SB    = "SB"
+	SW    = "SW"
+	ALLOC = "ALLOC"
+
+	// Stack opcodes
+	PUSH = "PUSH"
+	POP  = "POP"
+	CALL = "CALL"
+	RET  = "RET"
+
+	// Pseudo-instructions, expanded into real opcodes by the compiler
+	MOV  = "MOV"
+	INC  = "INC"
+	DEC  = "DEC"
+	CLR  = "CLR"
+	JMPZ = "JMPZ"
 )
 
 type Token struct {
 	Type    TokenType
 	Literal string
-	Line    int
+	Line    int // Line the token starts on, starting at 1
+	Column  int // Byte column the token starts at, starting at 1
+	Offset  int // Byte offset of the token's first character
+	Length  int // Length of the token in the source, including sigils like `#`
+
+	// File the token was read from, empty for source that didn't come from a file
+	File string
+	// The macro call this token was expanded from, nil for tokens read straight from the source
+	From *Token
+}
+
+// A location in the source
+type Position struct {
+	File   string
+	Line   int
+	Column int
+	Offset int
+}
+
+func (t Token) Pos() Position {
+	return Position{File: t.File, Line: t.Line, Column: t.Column, Offset: t.Offset}
+}
+
+// The position just after the token
+func (t Token) End() Position {
+	return Position{File: t.File, Line: t.Line, Column: t.Column + t.Length, Offset: t.Offset + t.Length}
+}
+
+// Formats the position as file:line:col, or line:col if it isn't in a file
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
 }
 
 var keywords = map[string]TokenType{
 	"load": LOAD,
+	"lui":  LUI,
 	"add":  ADD,
 	"sub":  SUB,
 	"mul":  MUL,
@@ -60,18 +202,91 @@ var keywords = map[string]TokenType{
 	"lte":  LTE,
 	"jmpe": JMPE,
 	"nop":  NOP,
+	"igl":  ILLEGAL,
+
+	"and": AND,
+	"or":  OR,
+	"xor": XOR,
+	"not": NOT,
+	"shl": SHL,
+	"shr": SHR,
+	"sar": SAR,
+
+	"mod":    MOD,
+	"rem":    REM,
+	"seteq":  SETEQ,
+	"setneq": SETNEQ,
+	"setgt":  SETGT,
+	"setlt":  SETLT,
+	"setgte": SETGTE,
+	"setlte": SETLTE,
+	"jmpne":  JMPNE,
+
+	"jz":  JZ,
+	"jnz": JNZ,
+	"jn":  JN,
+	"jnn": JNN,
+	"jc":  JC,
+	"jnc": JNC,
+	"jo":  JO,
+	"jno": JNO,
+
+	"addi": ADDI,
+	"subi": SUBI,
+	"muli": MULI,
+	"eqi":  EQI,
+	"neqi": NEQI,
+	"gti":  GTI,
+	"lti":  LTI,
+	"gtei": GTEI,
+	"ltei": LTEI,
+	"cmpi": CMPI,
+
+	"lb":    LB,
+	"lw":    LW,
+	"sb":    SB,
+	"sw":    SW,
+	"alloc": ALLOC,
+
+	"push": PUSH,
+	"pop":  POP,
+	"call": CALL,
+	"ret":  RET,
+
+	"mov":  MOV,
+	"inc":  INC,
+	"dec":  DEC,
+	"clr":  CLR,
+	"jmpz": JMPZ,
 }
 
 var directives = map[string]TokenType{
-	"code": CODE,
-	"data": DATA,
+	"code":   CODE,
+	"data":   DATA,
+	"byte":   BYTE,
+	"word":   WORD,
+	"asciiz": ASCIIZ,
+	"space":  SPACE,
+	"entry":  ENTRY,
+
+	"macro": MACRO,
+	"endm":  ENDM,
+
+	"include": INCLUDE,
+
+	"equ":    EQU,
+	"if":     IF,
+	"ifdef":  IFDEF,
+	"ifndef": IFNDEF,
+	"else":   ELSE,
+	"endif":  ENDIF,
 }
 
 func LookupIdent(ident string) TokenType {
 	if tok, ok := keywords[ident]; ok {
 		return tok
 	}
-	return ILLEGAL
+	return IDENT
 }
 
 func LookupDirective(ident string) TokenType {
@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"fmt"
+	"simpsel/code"
+)
+
+type FaultKind int
+
+const (
+	DivideByZero FaultKind = iota
+	PCOutOfBounds
+	MisalignedPC
+	BadRegister
+	IllegalOpcode
+	MemoryOutOfBounds
+	OutOfMemory
+	StackOverflow
+	StackUnderflow
+)
+
+var faultNames = map[FaultKind]string{
+	DivideByZero:      "Divide by zero",
+	PCOutOfBounds:     "PC out of bounds",
+	MisalignedPC:      "Misaligned PC",
+	BadRegister:       "Bad register",
+	IllegalOpcode:     "Illegal opcode",
+	MemoryOutOfBounds: "Memory out of bounds",
+	OutOfMemory:       "Out of memory",
+	StackOverflow:     "Stack overflow",
+	StackUnderflow:    "Stack underflow",
+}
+
+func (k FaultKind) String() string {
+	if name, ok := faultNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// A Fault stops the VM when a program does something it can't recover from
+type Fault struct {
+	Kind   FaultKind
+	PC     int         // Offset of the faulting instruction
+	Opcode code.Opcode // Opcode of the faulting instruction
+	Detail string      // Extra context, ie the address that was out of bounds
+	Source string      // The source line of the instruction, empty without a source map
+}
+
+func (f *Fault) Error() string {
+	msg := fmt.Sprintf("%s @ %d (opcode %02X)", f.Kind, f.PC, byte(f.Opcode))
+	if f.Detail != "" {
+		msg += ": " + f.Detail
+	}
+	if f.Source != "" {
+		msg += ", " + f.Source
+	}
+	return msg
+}
@@ -0,0 +1,86 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"simpsel/code"
+)
+
+// The status register, set by arithmetic, logic and compares. A compare sets
+// them as if it subtracted its second register from its first.
+type Flags uint8
+
+const (
+	FlagZero     Flags = 1 << iota // Z, the result was 0
+	FlagNegative                   // N, the result's sign bit is set
+	FlagCarry                      // C, an add carried out of bit 31, a sub borrowed, or a mul didn't fit unsigned
+	FlagOverflow                   // V, the signed result doesn't fit in 32 bits
+)
+
+// Formats the flags like `Z=1 N=0 C=0 V=0`
+func (f Flags) String() string {
+	bit := func(flag Flags) int {
+		if f&flag != 0 {
+			return 1
+		}
+		return 0
+	}
+	return fmt.Sprintf("Z=%d N=%d C=%d V=%d", bit(FlagZero), bit(FlagNegative), bit(FlagCarry), bit(FlagOverflow))
+}
+
+// Whether the conditional jump op is taken
+func (f Flags) taken(op code.Opcode) bool {
+	switch op {
+	case code.OpJz:
+		return f&FlagZero != 0
+	case code.OpJnz:
+		return f&FlagZero == 0
+	case code.OpJn:
+		return f&FlagNegative != 0
+	case code.OpJnn:
+		return f&FlagNegative == 0
+	case code.OpJc:
+		return f&FlagCarry != 0
+	case code.OpJnc:
+		return f&FlagCarry == 0
+	case code.OpJo:
+		return f&FlagOverflow != 0
+	}
+	return f&FlagOverflow == 0
+}
+
+// The flags for result, with C and V as given
+func resultFlags(result int32, carry, overflow bool) Flags {
+	var f Flags
+	if result == 0 {
+		f |= FlagZero
+	}
+	if result < 0 {
+		f |= FlagNegative
+	}
+	if carry {
+		f |= FlagCarry
+	}
+	if overflow {
+		f |= FlagOverflow
+	}
+	return f
+}
+
+func addFlags(a, b, result int32) Flags {
+	carry := uint32(result) < uint32(a)
+	overflow := (a^result)&(b^result) < 0
+	return resultFlags(result, carry, overflow)
+}
+
+func subFlags(a, b, result int32) Flags {
+	borrow := uint32(a) < uint32(b)
+	overflow := (a^b)&(a^result) < 0
+	return resultFlags(result, borrow, overflow)
+}
+
+func mulFlags(a, b, result int32) Flags {
+	carry := uint64(uint32(a))*uint64(uint32(b)) > math.MaxUint32
+	overflow := int64(a)*int64(b) != int64(result)
+	return resultFlags(result, carry, overflow)
+}
@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// How often, in instructions, the deadline and context are checked
+const checkInterval = 256
+
+type StopReason int
+
+const (
+	Halted StopReason = iota
+	EndOfProgram
+	Faulted
+	BudgetExhausted
+	DeadlineExceeded
+	Canceled
+)
+
+var stopReasonNames = map[StopReason]string{
+	Halted:           "halted",
+	EndOfProgram:     "reached the end of the program",
+	Faulted:          "faulted",
+	BudgetExhausted:  "instruction budget exhausted",
+	DeadlineExceeded: "deadline exceeded",
+	Canceled:         "canceled",
+}
+
+func (r StopReason) String() string {
+	if name, ok := stopReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+// Limits for a single run. The zero value runs until the program stops by itself.
+type RunOptions struct {
+	MaxInstructions int             // Stop after this many instructions, 0 for no limit
+	Deadline        time.Time       // Stop once this time has passed, zero for no deadline
+	Context         context.Context // Stop once this context is done, nil for none
+}
+
+// Why and after how many instructions a run stopped
+type Result struct {
+	Reason StopReason
+	Steps  int
+	Err    error // The fault, when Reason is Faulted
+}
+
+func (r Result) String() string {
+	if r.Reason == Faulted {
+		return fmt.Sprintf("%s after %d instructions: %s", r.Reason, r.Steps, r.Err)
+	}
+	return fmt.Sprintf("%s after %d instructions", r.Reason, r.Steps)
+}
+
+func (vm *VM) RunWithOptions(out io.Writer, opts RunOptions) Result {
+	var done <-chan struct{}
+	if opts.Context != nil {
+		done = opts.Context.Done()
+	}
+
+	steps := 0
+	for {
+		if opts.MaxInstructions > 0 && steps >= opts.MaxInstructions {
+			return Result{Reason: BudgetExhausted, Steps: steps}
+		}
+		if steps%checkInterval == 0 {
+			if !opts.Deadline.IsZero() && time.Now().After(opts.Deadline) {
+				return Result{Reason: DeadlineExceeded, Steps: steps}
+			}
+			select {
+			case <-done:
+				return Result{Reason: Canceled, Steps: steps}
+			default:
+			}
+		}
+
+		vm.halted = false
+		isDone, err := vm.step(out)
+		steps++
+		if err != nil {
+			return Result{Reason: Faulted, Steps: steps, Err: err}
+		}
+		if isDone {
+			if vm.halted {
+				return Result{Reason: Halted, Steps: steps}
+			}
+			return Result{Reason: EndOfProgram, Steps: steps - 1}
+		}
+	}
+}
@@ -4,132 +4,480 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"simpsel/code"
 	"simpsel/compiler"
 )
 
+const (
+	MaxMemory = 1 << 20 // The most bytes of memory a program may allocate
+	StackSize = 1024    // The number of values the stack can hold
+)
+
 type VM struct {
 	Registers []int32
 	Program   code.Instructions
+	Memory    []byte
+	Stack     []int32
+	SP        int // Stack pointer, the index of the next free stack slot
 	Counter   int
 	Remainder int32
 	EqualFlag bool
+	Flags     Flags // Z, N, C and V, from the last arithmetic, logic or compare
+	SourceMap []compiler.SourceLine // Where each instruction came from, can be empty
+
+	halted bool // Whether the last instruction was HLT
 }
 
 func New(bytecode *compiler.Bytecode) *VM {
+	memory := make([]byte, len(bytecode.Data))
+	copy(memory, bytecode.Data)
+
 	return &VM{
 		Registers: make([]int32, 32),
 		Program:   bytecode.Instructions,
-		Counter:   0,
+		Memory:    memory,
+		Stack:     make([]int32, StackSize),
+		SP:        0,
+		Counter:   bytecode.Entry,
 		Remainder: 0,
 		EqualFlag: false,
+		Flags:     0,
+		SourceMap: bytecode.SourceMap,
 	}
 }
 
-func (vm *VM) Run(out io.Writer) {
-	isDone := false
-	for !isDone {
-		isDone = vm.executeInstruction(out)
+func (vm *VM) Run(out io.Writer) error {
+	return vm.RunWithOptions(out, RunOptions{}).Err
+}
+
+func (vm *VM) RunOnce(out io.Writer) error {
+	_, err := vm.step(out)
+	return err
+}
+
+// Runs one instruction, saying where in the source it came from if it faults
+func (vm *VM) step(out io.Writer) (bool, error) {
+	done, err := vm.executeInstruction(out)
+	if fault, ok := err.(*Fault); ok {
+		fault.Source = vm.Source(fault.PC)
 	}
+	return done, err
 }
 
-func (vm *VM) RunOnce(out io.Writer) {
-	vm.executeInstruction(out)
+// Describes the instruction at pc and the source line it came from, ie
+// `test.sasm:7: add $2 $1 $2`. Empty if the source map doesn't cover pc.
+func (vm *VM) Source(pc int) string {
+	line, ok := compiler.Locate(vm.SourceMap, pc)
+	if !ok {
+		return ""
+	}
+
+	location := fmt.Sprintf("line %d", line.Line)
+	if line.File != "" {
+		location = fmt.Sprintf("%s:%d", line.File, line.Line)
+	}
+	if pc+code.InstructionWidth > len(vm.Program) {
+		return location
+	}
+	ins, err := code.FormatInstruction(vm.Program[pc:])
+	if err != nil {
+		return location
+	}
+	return location + ": " + ins
 }
 
-func (vm *VM) executeInstruction(out io.Writer) bool {
-	if vm.Counter >= len(vm.Program) {
-		return true
+func (vm *VM) executeInstruction(out io.Writer) (bool, error) {
+	if vm.Counter == len(vm.Program) {
+		return true, nil
+	}
+	pc := vm.Counter
+	if pc < 0 || pc+4 > len(vm.Program) {
+		return true, &Fault{Kind: PCOutOfBounds, PC: pc, Opcode: code.OpIgl}
+	}
+	if pc%4 != 0 {
+		return true, &Fault{Kind: MisalignedPC, PC: pc, Opcode: code.OpIgl}
+	}
+
+	op := vm.decodeOpcode()
+	def, err := code.Lookup(byte(op))
+	if err != nil || op == code.OpIgl {
+		vm.Counter = pc + 4 // Skip the operands so REPL isn't messed up
+		return true, &Fault{Kind: IllegalOpcode, PC: pc, Opcode: op}
 	}
-	switch vm.decodeOpcode() {
+	operands := code.ReadOperands(def, vm.Program[pc+1:])
+	for i, ot := range def.Operands {
+		if ot == code.Register && operands[i] >= len(vm.Registers) {
+			vm.Counter = pc + 4
+			return true, &Fault{Kind: BadRegister, PC: pc, Opcode: op,
+				Detail: fmt.Sprintf("register $%d", operands[i])}
+		}
+	}
+
+	switch op {
 	case code.OpLoad:
 		register := vm.nextByte()
 		num := int32(vm.next2Bytes())
 		vm.Registers[register] = num
+	case code.OpLui:
+		// Replaces the upper half and keeps the lower half from a previous load
+		register := vm.nextByte()
+		upper := uint32(vm.next2Bytes()) << 16
+		vm.Registers[register] = int32(upper | uint32(vm.Registers[register])&0xFFFF)
 	case code.OpAdd:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
-		vm.Registers[vm.nextByte()] = register1 + register2
+		result := register1 + register2
+		vm.Flags = addFlags(register1, register2, result)
+		vm.Registers[vm.nextByte()] = result
 	case code.OpSub:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
-		vm.Registers[vm.nextByte()] = register1 - register2
+		result := register1 - register2
+		vm.Flags = subFlags(register1, register2, result)
+		vm.Registers[vm.nextByte()] = result
 	case code.OpMul:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
-		vm.Registers[vm.nextByte()] = register1 * register2
+		result := register1 * register2
+		vm.Flags = mulFlags(register1, register2, result)
+		vm.Registers[vm.nextByte()] = result
+	case code.OpAddi, code.OpSubi, code.OpMuli:
+		// Like add, sub and mul with an immediate for the second register, the result goes back in the first
+		register := vm.nextByte()
+		value := vm.Registers[register]
+		imm := int32(vm.next2Bytes())
+		var result int32
+		switch op {
+		case code.OpAddi:
+			result = value + imm
+			vm.Flags = addFlags(value, imm, result)
+		case code.OpSubi:
+			result = value - imm
+			vm.Flags = subFlags(value, imm, result)
+		default:
+			result = value * imm
+			vm.Flags = mulFlags(value, imm, result)
+		}
+		vm.Registers[register] = result
 	case code.OpDiv:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
-		vm.Registers[vm.nextByte()] = register1 / register2
+		register3 := vm.nextByte()
+		if register2 == 0 {
+			return true, &Fault{Kind: DivideByZero, PC: pc, Opcode: op}
+		}
+		// The only quotient that doesn't fit is MinInt32 / -1, which wraps
+		result := register1 / register2
+		vm.Flags = resultFlags(result, false, register1 == math.MinInt32 && register2 == -1)
+		vm.Registers[register3] = result
 		vm.Remainder = register1 % register2
-	case code.OpHlt:
-		fmt.Fprintf(out, "HLT Encountered\n")
-		vm.nextByte() // Read bytes so REPL isn't messed up
+	case code.OpMod:
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		register3 := vm.nextByte()
+		if register2 == 0 {
+			return true, &Fault{Kind: DivideByZero, PC: pc, Opcode: op}
+		}
+		result := register1 % register2
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[register3] = result
+	case code.OpRem:
+		vm.Registers[vm.nextByte()] = vm.Remainder
+		vm.nextByte()
 		vm.nextByte()
+	case code.OpAnd:
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		result := register1 & register2
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[vm.nextByte()] = result
+	case code.OpOr:
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		result := register1 | register2
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[vm.nextByte()] = result
+	case code.OpXor:
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		result := register1 ^ register2
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[vm.nextByte()] = result
+	case code.OpNot:
+		register1 := vm.Registers[vm.nextByte()]
+		result := ^register1
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[vm.nextByte()] = result
 		vm.nextByte()
-		return true
-	case code.OpIgl:
-		fmt.Fprintf(out, "Illegal Opcode @ %d\n", vm.Counter - 1)
+	case code.OpShl:
+		// The amount is unsigned, so a negative one shifts by 32 or more like
+		// any other, leaving 0, or the sign for sar
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		result := int32(uint32(register1) << uint32(register2))
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[vm.nextByte()] = result
+	case code.OpShr:
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		result := int32(uint32(register1) >> uint32(register2))
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[vm.nextByte()] = result
+	case code.OpSar:
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		result := register1 >> uint32(register2)
+		vm.Flags = resultFlags(result, false, false)
+		vm.Registers[vm.nextByte()] = result
+	case code.OpHlt:
+		if source := vm.Source(pc); source != "" {
+			fmt.Fprintf(out, "HLT Encountered @ %d, %s\n", pc, source)
+		} else {
+			fmt.Fprintf(out, "HLT Encountered\n")
+		}
 		vm.nextByte() // Read bytes so REPL isn't messed up
 		vm.nextByte()
 		vm.nextByte()
-		return true
+		vm.halted = true
+		return true, nil
 	case code.OpJmp:
 		target := vm.Registers[vm.nextByte()]
-		vm.Counter = int(target)
+		return false, vm.jump(pc, op, int(target))
 	case code.OpJmpf:
 		value := vm.Registers[vm.nextByte()]
-		vm.Counter += int(value)
+		return false, vm.jump(pc, op, pc+4+int(value))
 	case code.OpJmpb:
 		value := vm.Registers[vm.nextByte()]
-		vm.Counter -= int(value)
+		return false, vm.jump(pc, op, pc+4-int(value))
 	case code.OpEq:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
 		vm.EqualFlag = register1 == register2
+		vm.Flags = subFlags(register1, register2, register1-register2)
 		vm.nextByte()
 	case code.OpNeq:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
 		vm.EqualFlag = register1 != register2
+		vm.Flags = subFlags(register1, register2, register1-register2)
 		vm.nextByte()
 	case code.OpGt:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
 		vm.EqualFlag = register1 > register2
+		vm.Flags = subFlags(register1, register2, register1-register2)
 		vm.nextByte()
 	case code.OpLt:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
 		vm.EqualFlag = register1 < register2
+		vm.Flags = subFlags(register1, register2, register1-register2)
 		vm.nextByte()
 	case code.OpGte:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
 		vm.EqualFlag = register1 >= register2
+		vm.Flags = subFlags(register1, register2, register1-register2)
 		vm.nextByte()
 	case code.OpLte:
 		register1 := vm.Registers[vm.nextByte()]
 		register2 := vm.Registers[vm.nextByte()]
 		vm.EqualFlag = register1 <= register2
+		vm.Flags = subFlags(register1, register2, register1-register2)
 		vm.nextByte()
+	case code.OpEqi, code.OpNeqi, code.OpGti, code.OpLti, code.OpGtei, code.OpLtei:
+		register := vm.Registers[vm.nextByte()]
+		imm := int32(vm.next2Bytes())
+		vm.EqualFlag = compare(op, register, imm)
+		vm.Flags = subFlags(register, imm, register-imm)
+	case code.OpCmpi:
+		// Only sets the flags, as if it subtracted the immediate, leaving the equal flag alone
+		register := vm.Registers[vm.nextByte()]
+		imm := int32(vm.next2Bytes())
+		vm.Flags = subFlags(register, imm, register-imm)
 	case code.OpJmpe:
 		if vm.EqualFlag {
 			target := vm.Registers[vm.nextByte()]
-			vm.Counter = int(target)
+			return false, vm.jump(pc, op, int(target))
 		} else {
 			vm.nextByte()
 			vm.nextByte()
 			vm.nextByte()
 		}
+	case code.OpJmpne:
+		if !vm.EqualFlag {
+			target := vm.Registers[vm.nextByte()]
+			return false, vm.jump(pc, op, int(target))
+		} else {
+			vm.nextByte()
+			vm.nextByte()
+			vm.nextByte()
+		}
+	case code.OpJz, code.OpJnz, code.OpJn, code.OpJnn, code.OpJc, code.OpJnc, code.OpJo, code.OpJno:
+		target := vm.Registers[vm.nextByte()]
+		if vm.Flags.taken(op) {
+			return false, vm.jump(pc, op, int(target))
+		}
+		vm.nextByte()
+		vm.nextByte()
+	case code.OpSeteq, code.OpSetneq, code.OpSetgt, code.OpSetlt, code.OpSetgte, code.OpSetlte:
+		// Like the compare of the same name, but the result goes in a register as 1 or 0
+		register1 := vm.Registers[vm.nextByte()]
+		register2 := vm.Registers[vm.nextByte()]
+		var result int32
+		if compare(op, register1, register2) {
+			result = 1
+		}
+		vm.Registers[vm.nextByte()] = result
 	case code.OpNop:
 		vm.nextByte()
 		vm.nextByte()
 		vm.nextByte()
+	case code.OpLb:
+		address := vm.Registers[vm.nextByte()]
+		register := vm.nextByte()
+		vm.nextByte()
+		if !vm.inBounds(address, 1) {
+			return true, vm.memoryFault(pc, op, address)
+		}
+		vm.Registers[register] = int32(vm.Memory[address])
+	case code.OpLw:
+		address := vm.Registers[vm.nextByte()]
+		register := vm.nextByte()
+		vm.nextByte()
+		if !vm.inBounds(address, 4) {
+			return true, vm.memoryFault(pc, op, address)
+		}
+		vm.Registers[register] = int32(binary.LittleEndian.Uint32(vm.Memory[address:]))
+	case code.OpSb:
+		value := vm.Registers[vm.nextByte()]
+		address := vm.Registers[vm.nextByte()]
+		vm.nextByte()
+		if !vm.inBounds(address, 1) {
+			return true, vm.memoryFault(pc, op, address)
+		}
+		vm.Memory[address] = byte(value)
+	case code.OpSw:
+		value := vm.Registers[vm.nextByte()]
+		address := vm.Registers[vm.nextByte()]
+		vm.nextByte()
+		if !vm.inBounds(address, 4) {
+			return true, vm.memoryFault(pc, op, address)
+		}
+		binary.LittleEndian.PutUint32(vm.Memory[address:], uint32(value))
+	case code.OpAlloc:
+		size := vm.Registers[vm.nextByte()]
+		register := vm.nextByte()
+		vm.nextByte()
+		if size < 0 || len(vm.Memory)+int(size) > MaxMemory {
+			return true, &Fault{Kind: OutOfMemory, PC: pc, Opcode: op,
+				Detail: fmt.Sprintf("can't allocate %d bytes", size)}
+		}
+		vm.Registers[register] = int32(len(vm.Memory))
+		vm.Memory = append(vm.Memory, make([]byte, size)...)
+	case code.OpPush:
+		value := vm.Registers[vm.nextByte()]
+		vm.nextByte()
+		vm.nextByte()
+		if !vm.push(value) {
+			return true, &Fault{Kind: StackOverflow, PC: pc, Opcode: op}
+		}
+	case code.OpPop:
+		register := vm.nextByte()
+		vm.nextByte()
+		vm.nextByte()
+		value, ok := vm.pop()
+		if !ok {
+			return true, &Fault{Kind: StackUnderflow, PC: pc, Opcode: op}
+		}
+		vm.Registers[register] = value
+	case code.OpCall:
+		target := vm.Registers[vm.nextByte()]
+		vm.nextByte()
+		vm.nextByte()
+		if !vm.push(int32(vm.Counter)) {
+			return true, &Fault{Kind: StackOverflow, PC: pc, Opcode: op}
+		}
+		return false, vm.jump(pc, op, int(target))
+	case code.OpCalli:
+		target := vm.next2Bytes()
+		vm.nextByte()
+		if !vm.push(int32(vm.Counter)) {
+			return true, &Fault{Kind: StackOverflow, PC: pc, Opcode: op}
+		}
+		return false, vm.jump(pc, op, int(target))
+	case code.OpRet:
+		vm.nextByte()
+		vm.nextByte()
+		vm.nextByte()
+		target, ok := vm.pop()
+		if !ok {
+			return true, &Fault{Kind: StackUnderflow, PC: pc, Opcode: op}
+		}
+		return false, vm.jump(pc, op, int(target))
 	}
 
-	return false
+	return false, nil
+}
+
+// Compares a and b the way a set<cc> or compare immediate opcode does
+func compare(op code.Opcode, a, b int32) bool {
+	switch op {
+	case code.OpSeteq, code.OpEqi:
+		return a == b
+	case code.OpSetneq, code.OpNeqi:
+		return a != b
+	case code.OpSetgt, code.OpGti:
+		return a > b
+	case code.OpSetlt, code.OpLti:
+		return a < b
+	case code.OpSetgte, code.OpGtei:
+		return a >= b
+	}
+	return a <= b
+}
+
+// Moves the counter to target, faulting if target isn't the start of an instruction.
+// Relative jumps are measured from the instruction after the jump.
+func (vm *VM) jump(pc int, op code.Opcode, target int) error {
+	vm.Counter = pc + 4
+	if target < 0 || target > len(vm.Program) {
+		return &Fault{Kind: PCOutOfBounds, PC: pc, Opcode: op,
+			Detail: fmt.Sprintf("jump to %d", target)}
+	}
+	if target%4 != 0 {
+		return &Fault{Kind: MisalignedPC, PC: pc, Opcode: op,
+			Detail: fmt.Sprintf("jump to %d", target)}
+	}
+	vm.Counter = target
+	return nil
+}
+
+func (vm *VM) inBounds(address int32, width int) bool {
+	return address >= 0 && int(address)+width <= len(vm.Memory)
+}
+
+func (vm *VM) memoryFault(pc int, op code.Opcode, address int32) error {
+	return &Fault{Kind: MemoryOutOfBounds, PC: pc, Opcode: op,
+		Detail: fmt.Sprintf("address %d", address)}
+}
+
+func (vm *VM) push(value int32) bool {
+	if vm.SP >= len(vm.Stack) {
+		return false
+	}
+	vm.Stack[vm.SP] = value
+	vm.SP++
+	return true
+}
+
+func (vm *VM) pop() (int32, bool) {
+	if vm.SP <= 0 {
+		return 0, false
+	}
+	vm.SP--
+	return vm.Stack[vm.SP], true
 }
 
 func (vm *VM) decodeOpcode() code.Opcode {
@@ -2,12 +2,15 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"simpsel/ast"
+	"simpsel/code"
 	"simpsel/compiler"
 	"simpsel/lexer"
 	"simpsel/parser"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -74,4 +77,527 @@ func TestIntegerArithmetic(t *testing.T) {
 	}
 
 	runVmTests(t, tests)
-}
\ No newline at end of file
+}
+
+func TestWideLoad(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $31 #65536", 2, 65536},
+		{"load $31 #-1", 2, -1},
+		{"load $31 #-2147483648", 2, -2147483648},
+		{"load $31 #0xFFFFFFFF", 2, -1},
+		{"load $31 #0x12345678", 2, 0x12345678},
+		{"load $31 #0x1234\nlui $31 #0xABCD", 2, -1412623820},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestBitwise(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #0xF0F0\nload $1 #0xFF00\nand $0 $1 $31", 3, 0xF000},
+		{"load $0 #0xF0F0\nload $1 #0xFF00\nor $0 $1 $31", 3, 0xFFF0},
+		{"load $0 #0xF0F0\nload $1 #0xFF00\nxor $0 $1 $31", 3, 0x0FF0},
+		{"load $31 #5\nload $0 #-1\nxor $0 $0 $31", 4, 0},
+		{"load $0 #0\nnot $0 $31", 2, -1},
+		{"load $0 #0x12345678\nnot $0 $31", 3, -0x12345679},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestShifts(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #3\nload $1 #4\nshl $0 $1 $31", 3, 48},
+		{"load $0 #1\nload $1 #31\nshl $0 $1 $31", 3, -2147483648},
+		{"load $31 #5\nload $0 #1\nload $1 #32\nshl $0 $1 $31", 4, 0},
+		{"load $31 #5\nload $0 #1\nload $1 #33\nshl $0 $1 $31", 4, 0},
+		{"load $31 #5\nload $0 #1\nload $1 #-1\nshl $0 $1 $31", 5, 0},
+
+		// shr fills with 0s, sar with copies of the sign bit
+		{"load $0 #-16\nload $1 #2\nshr $0 $1 $31", 4, 0x3FFFFFFC},
+		{"load $0 #-16\nload $1 #2\nsar $0 $1 $31", 4, -4},
+		{"load $0 #16\nload $1 #2\nsar $0 $1 $31", 3, 4},
+		{"load $0 #-16\nload $1 #0\nshr $0 $1 $31", 4, -16},
+		{"load $0 #-16\nload $1 #0\nsar $0 $1 $31", 4, -16},
+		{"load $0 #-1\nload $1 #31\nshr $0 $1 $31", 4, 1},
+		{"load $31 #5\nload $0 #-1\nload $1 #32\nshr $0 $1 $31", 5, 0},
+		{"load $0 #-16\nload $1 #32\nsar $0 $1 $31", 4, -1},
+		{"load $0 #-16\nload $1 #100\nsar $0 $1 $31", 4, -1},
+		{"load $0 #-16\nload $1 #-1\nsar $0 $1 $31", 5, -1},
+		{"load $31 #5\nload $0 #16\nload $1 #40\nsar $0 $1 $31", 4, 0},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRemainder(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #17\nload $1 #5\nmod $0 $1 $31", 3, 2},
+		{"load $0 #-17\nload $1 #5\nmod $0 $1 $31", 4, -2},
+		{"load $0 #17\nload $1 #-5\nmod $0 $1 $31", 4, 2},
+		{"load $31 #5\nload $0 #-2147483648\nload $1 #-1\nmod $0 $1 $31", 6, 0},
+		{"load $0 #17\nload $1 #5\ndiv $0 $1 $2\nrem $31", 4, 2},
+		{"load $0 #-17\nload $1 #5\ndiv $0 $1 $2\nrem $31", 5, -2},
+		// Nothing has divided yet
+		{"load $31 #5\nrem $31", 2, 0},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSetCompare(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #1\nload $1 #1\nseteq $0 $1 $31", 3, 1},
+		{"load $0 #1\nload $1 #2\nseteq $0 $1 $31", 3, 0},
+		{"load $0 #1\nload $1 #2\nsetneq $0 $1 $31", 3, 1},
+		{"load $0 #1\nload $1 #1\nsetneq $0 $1 $31", 3, 0},
+		{"load $0 #2\nload $1 #1\nsetgt $0 $1 $31", 3, 1},
+		{"load $0 #1\nload $1 #1\nsetgt $0 $1 $31", 3, 0},
+		{"load $0 #-1\nload $1 #1\nsetlt $0 $1 $31", 4, 1},
+		{"load $0 #1\nload $1 #1\nsetlt $0 $1 $31", 3, 0},
+		{"load $0 #1\nload $1 #1\nsetgte $0 $1 $31", 3, 1},
+		{"load $0 #1\nload $1 #2\nsetgte $0 $1 $31", 3, 0},
+		{"load $0 #1\nload $1 #1\nsetlte $0 $1 $31", 3, 1},
+		{"load $0 #2\nload $1 #1\nsetlte $0 $1 $31", 3, 0},
+	}
+
+	runVmTests(t, tests)
+
+	// The flag is left alone
+	vm := New(compile(t, "load $0 #1\neq $0 $0\nsetneq $0 $0 $1"))
+	for i := 0; i < 3; i++ {
+		vm.executeInstruction(bytes.NewBuffer([]byte{}))
+	}
+	if !vm.EqualFlag {
+		t.Errorf("setneq changed the equal flag")
+	}
+}
+
+func TestImmediateArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $31 #5\nadd $31 #3 $31", 2, 8},
+		{"load $31 #5\nsub $31 #7 $31", 2, -2},
+		{"load $31 #-2\nmul $31 #3 $31", 3, -6},
+		{"load $31 #1\naddi $31 #65535", 2, 65536},
+		// The immediate isn't sign extended
+		{"load $31 #0\nsubi $31 #65535", 2, -65535},
+		{"load $31 #7\nmuli $31 #0", 2, 0},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCompareImmediate(t *testing.T) {
+	tests := []struct {
+		input    string
+		numInst  int
+		expected bool
+	}{
+		{"load $0 #65535\neq $0 #65535", 2, true},
+		{"load $0 #-1\neq $0 #65535", 3, false},
+		{"load $0 #1\nneq $0 #2", 2, true},
+		{"load $0 #3\ngt $0 #2", 2, true},
+		{"load $0 #-1\nlt $0 #0", 3, true},
+		{"load $0 #3\ngte $0 #3", 2, true},
+		{"load $0 #4\nlte $0 #3", 2, false},
+		// cmpi only sets the status flags
+		{"load $0 #1\neq $0 #1\ncmpi $0 #2", 3, true},
+	}
+
+	for _, tt := range tests {
+		vm := New(compile(t, tt.input))
+		for i := 0; i < tt.numInst; i++ {
+			vm.executeInstruction(bytes.NewBuffer([]byte{}))
+		}
+
+		if vm.EqualFlag != tt.expected {
+			t.Errorf("wrong equal flag for %q. want=%t, got=%t", tt.input, tt.expected, vm.EqualFlag)
+		}
+	}
+}
+
+func TestJmpne(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $31 #5\nload $0 #1\nload $1 #2\nload $2 @skip\neq $0 $1\njmpne $2\nload $31 #1\nskip:\nhlt", 7, 5},
+		{"load $31 #5\nload $0 #1\nload $1 #1\nload $2 @skip\neq $0 $1\njmpne $2\nload $31 #1\nskip:\nhlt", 7, 1},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFlags(t *testing.T) {
+	tests := []struct {
+		input    string
+		numInst  int
+		expected Flags
+	}{
+		{"load $0 #1\nload $1 #-1\nadd $0 $1 $2", 4, FlagZero | FlagCarry},
+		{"load $0 #0x7FFFFFFF\nload $1 #1\nadd $0 $1 $2", 4, FlagNegative | FlagOverflow},
+		{"load $0 #-1\nadd $0 $0 $2", 3, FlagNegative | FlagCarry},
+		{"load $0 #1\nload $1 #2\nadd $0 $1 $2", 3, 0},
+		{"load $0 #1\nload $1 #2\nsub $0 $1 $2", 3, FlagNegative | FlagCarry},
+		{"load $0 #-2147483648\nload $1 #1\nsub $0 $1 $2", 4, FlagOverflow},
+		{"load $0 #5\nsub $0 $0 $2", 2, FlagZero},
+		{"load $0 #65536\nmul $0 $0 $2", 3, FlagZero | FlagCarry | FlagOverflow},
+		{"load $0 #-1\nmul $0 $0 $2", 3, FlagCarry},
+		{"load $0 #-2\nload $1 #3\nmul $0 $1 $2", 4, FlagNegative | FlagCarry},
+		{"load $0 #-2147483648\nload $1 #-1\ndiv $0 $1 $2", 5, FlagNegative | FlagOverflow},
+		{"load $0 #7\nload $1 #7\nmod $0 $1 $2", 3, FlagZero},
+		{"load $0 #0xF0\nload $1 #0x0F\nand $0 $1 $2", 3, FlagZero},
+		{"load $0 #0\nnot $0 $2", 2, FlagNegative},
+		{"load $0 #1\nload $1 #31\nshl $0 $1 $2", 3, FlagNegative},
+		// Compares set them like a sub
+		{"load $0 #1\nload $1 #2\nlt $0 $1", 3, FlagNegative | FlagCarry},
+		{"load $0 #5\neq $0 $0", 2, FlagZero},
+		{"load $0 #-1\nadd $0 $0 $2\nload $1 #3\ngt $1 $1", 5, FlagZero},
+		{"load $0 #0xFFFFFFFF\naddi $0 #1", 3, FlagZero | FlagCarry},
+		{"load $0 #1\ncmpi $0 #2", 2, FlagNegative | FlagCarry},
+		{"load $0 #5\neq $0 #5", 2, FlagZero},
+		// Loads leave them alone
+		{"load $0 #5\nsub $0 $0 $2\nload $3 #5\nload $4 #-5", 5, FlagZero},
+	}
+
+	for _, tt := range tests {
+		vm := New(compile(t, tt.input))
+		for i := 0; i < tt.numInst; i++ {
+			vm.executeInstruction(bytes.NewBuffer([]byte{}))
+		}
+
+		if vm.Flags != tt.expected {
+			t.Errorf("wrong flags for %q. want=%s, got=%s", tt.input, tt.expected, vm.Flags)
+		}
+	}
+}
+
+func TestFlagJumps(t *testing.T) {
+	// Each sets the flags in numInst instructions, then jumps over `load $31 #1` if the jump is taken
+	setups := []struct {
+		input   string
+		numInst int
+	}{
+		{"load $0 #1\nsub $0 $0 $3", 2},                      // Z
+		{"load $0 #1\nload $1 #2\nsub $0 $1 $3", 3},          // N and C
+		{"load $0 #0x7FFFFFFF\nload $1 #1\nadd $0 $1 $3", 4}, // N and V
+		{"load $0 #2\nload $1 #1\nsub $0 $1 $3", 3},          // none
+	}
+	tests := []struct {
+		jump  string
+		taken []bool // For each setup
+	}{
+		{"jz", []bool{true, false, false, false}},
+		{"jnz", []bool{false, true, true, true}},
+		{"jn", []bool{false, true, true, false}},
+		{"jnn", []bool{true, false, false, true}},
+		{"jc", []bool{false, true, false, false}},
+		{"jnc", []bool{true, false, true, true}},
+		{"jo", []bool{false, false, true, false}},
+		{"jno", []bool{true, true, false, true}},
+	}
+
+	for _, tt := range tests {
+		for i, setup := range setups {
+			input := fmt.Sprintf("load $31 #5\n%s\nload $2 @skip\n%s $2\nload $31 #1\nskip:\nhlt",
+				setup.input, tt.jump)
+			expected := 1
+			if tt.taken[i] {
+				expected = 5
+			}
+			runVmTests(t, []vmTestCase{{input, setup.numInst + 4, expected}})
+		}
+	}
+}
+
+func TestLabelJumps(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #3\nload $1 #1\nload $30 @loop\nloop:\nadd $31 $1 $31\nneq $0 $31\njmpe $30", 12, 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestDataMemory(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(".data\n.byte #7, #8\n.code\nhlt"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := comp.Bytecode()
+	vm := New(bytecode)
+
+	if len(vm.Memory) != 2 || vm.Memory[0] != 7 || vm.Memory[1] != 8 {
+		t.Fatalf("vm.Memory wrong. got=%v", vm.Memory)
+	}
+
+	vm.Memory[0] = 9
+	if bytecode.Data[0] != 7 {
+		t.Errorf("vm.Memory shares storage with bytecode.Data")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #4\nalloc $0 $1\nload $2 #1234\nsw $2 $1\nlw $1 $31", 5, 1234},
+		{"load $0 #8\nalloc $0 $1\nalloc $0 $31", 3, 8},
+		{"load $0 #1\nalloc $0 $1\nload $2 #258\nsb $2 $1\nlb $1 $31", 5, 2},
+		{".data\nv: .byte #200\n.code\nload $0 @v\nlb $0 $31", 2, 200},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestMemoryFault(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected FaultKind
+	}{
+		{"load $0 #0\nlb $0 $31", MemoryOutOfBounds},
+		{"load $0 #2\nalloc $0 $1\nlw $1 $31", MemoryOutOfBounds},
+		{"load $0 #0\nload $1 #1\nsub $0 $1 $0\nalloc $0 $31", OutOfMemory},
+	}
+
+	for _, tt := range tests {
+		testFault(t, compile(t, tt.input), tt.expected)
+	}
+}
+
+func TestStack(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #7\npush $0\nload $0 #0\npop $31", 4, 7},
+		{"load $0 #1\nload $1 #2\npush $0\npush $1\npop $31", 5, 2},
+		{"call @double\nhlt\ndouble:\nload $0 #21\nadd $0 $0 $31\nret", 5, 42},
+		{"load $1 @double\ncall $1\nhlt\ndouble:\nload $0 #21\nadd $0 $0 $31\nret", 6, 42},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCallReturnsToCaller(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("call @sub\nload $31 #1\nhlt\nsub:\nret"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	vm.Run(bytes.NewBuffer([]byte{}))
+
+	if vm.Registers[31] != 1 {
+		t.Errorf("call did not return to the caller. $31=%d", vm.Registers[31])
+	}
+
+	if vm.SP != 0 {
+		t.Errorf("stack not empty after ret. SP=%d", vm.SP)
+	}
+}
+
+func TestStackFault(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected FaultKind
+	}{
+		{"pop $0", StackUnderflow},
+		{"ret", StackUnderflow},
+		{"loop:\ncall @loop", StackOverflow},
+	}
+
+	for _, tt := range tests {
+		testFault(t, compile(t, tt.input), tt.expected)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		bytecode *compiler.Bytecode
+		expected FaultKind
+		pc       int
+	}{
+		{compile(t, "load $0 #1\ndiv $0 $1 $2"), DivideByZero, 4},
+		{compile(t, "load $0 #1\nmod $0 $1 $2"), DivideByZero, 4},
+		{compile(t, "load $0 #100\njmp $0"), PCOutOfBounds, 4},
+		{compile(t, "load $0 #2\njmp $0"), MisalignedPC, 4},
+		{compile(t, "load $0 #12\njmpb $0"), PCOutOfBounds, 4},
+		{compile(t, "load $0 #2\njmpf $0\nhlt\nhlt"), MisalignedPC, 4},
+		{compile(t, "igl"), IllegalOpcode, 0},
+		{&compiler.Bytecode{Instructions: []byte{0x7F, 0, 0, 0}}, IllegalOpcode, 0},
+		{&compiler.Bytecode{Instructions: []byte{byte(code.OpAdd), 0, 1, 32}}, BadRegister, 0},
+		{&compiler.Bytecode{Instructions: []byte{byte(code.OpNop), 0, 0, 0, byte(code.OpNop), 0}}, PCOutOfBounds, 4},
+	}
+
+	for _, tt := range tests {
+		fault := testFault(t, tt.bytecode, tt.expected)
+		if fault != nil && fault.PC != tt.pc {
+			t.Errorf("fault.PC wrong. want=%d, got=%d", tt.pc, fault.PC)
+		}
+	}
+}
+
+func TestRelativeJumps(t *testing.T) {
+	tests := []vmTestCase{
+		{"load $0 #4\njmpf $0\nload $31 #1\nload $31 #2", 3, 2},
+		{"load $0 #8\nload $1 #1\nadd $31 $1 $31\njmpb $0", 6, 2},
+	}
+
+	runVmTests(t, tests)
+}
+
+// jmpf and jmpb count from the instruction after the jump, not from the jump itself
+func TestRelativeJumpBase(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"load $0 #0\njmpf $0\nhlt", 8},
+		{"load $0 #4\njmpf $0\nhlt\nhlt", 12},
+		{"load $0 #4\njmpb $0", 4},
+		{"load $0 #8\njmpb $0", 0},
+	}
+
+	for _, tt := range tests {
+		vm := New(compile(t, tt.input))
+		for i := 0; i < 2; i++ {
+			if _, err := vm.executeInstruction(bytes.NewBuffer([]byte{})); err != nil {
+				t.Fatalf("unexpected fault for %q: %s", tt.input, err)
+			}
+		}
+
+		if vm.Counter != tt.expected {
+			t.Errorf("wrong counter after the jump in %q. want=%d, got=%d",
+				tt.input, tt.expected, vm.Counter)
+		}
+	}
+}
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	t.Helper()
+
+	return compileWithOptions(t, input, compiler.Options{ScratchRegister: compiler.DefaultScratchRegister})
+}
+
+func compileWithOptions(t *testing.T, input string, opts compiler.Options) *compiler.Bytecode {
+	t.Helper()
+
+	comp := compiler.NewWithOptions(opts)
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	return comp.Bytecode()
+}
+
+func testFault(t *testing.T, bytecode *compiler.Bytecode, expected FaultKind) *Fault {
+	t.Helper()
+
+	vm := New(bytecode)
+	err := vm.Run(bytes.NewBuffer([]byte{}))
+
+	fault, ok := err.(*Fault)
+	if !ok {
+		t.Errorf("expected a *Fault. got=%T (%v)", err, err)
+		return nil
+	}
+
+	if fault.Kind != expected {
+		t.Errorf("fault.Kind wrong. want=%s, got=%s", expected, fault.Kind)
+	}
+
+	return fault
+}
+
+func TestRunWithOptions(t *testing.T) {
+	loop := "loop:\nload $0 @loop\njmp $0"
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		opts     RunOptions
+		expected StopReason
+		steps    int
+	}{
+		{"nop\nhlt", RunOptions{}, Halted, 2},
+		{"nop\nnop", RunOptions{}, EndOfProgram, 2},
+		{"pop $0", RunOptions{}, Faulted, 1},
+		{loop, RunOptions{MaxInstructions: 10}, BudgetExhausted, 10},
+		{loop, RunOptions{Deadline: time.Now().Add(-time.Second)}, DeadlineExceeded, 0},
+		{loop, RunOptions{Context: canceled}, Canceled, 0},
+	}
+
+	for _, tt := range tests {
+		vm := New(compile(t, tt.input))
+		result := vm.RunWithOptions(bytes.NewBuffer([]byte{}), tt.opts)
+
+		if result.Reason != tt.expected {
+			t.Errorf("result.Reason wrong for %q. want=%s, got=%s",
+				tt.input, tt.expected, result.Reason)
+		}
+
+		if result.Steps != tt.steps {
+			t.Errorf("result.Steps wrong for %q. want=%d, got=%d",
+				tt.input, tt.steps, result.Steps)
+		}
+	}
+}
+
+// Jumps that don't go through a label can land in the middle of a block, so
+// the optimiser mustn't fold anything it thinks it knows there
+func TestOptimizedRuns(t *testing.T) {
+	tests := []string{
+		// A loop back to a literal offset
+		"load $1 #1\nload $2 #0\nload $0 #5\nload $31 #16\nadd $2 $1 $2\nneq $0 $2\njmpe $31\nhlt",
+		// A loop back with jmpb
+		"load $1 #1\nload $2 #0\nload $0 #5\nload $29 #16\nload $31 @done\nadd $2 $1 $2\neq $0 $2\njmpe $31\njmpb $29\ndone:\nhlt",
+	}
+
+	for _, input := range tests {
+		var registers [][]int32
+		for _, optimize := range []bool{false, true} {
+			opts := compiler.Options{ScratchRegister: compiler.DefaultScratchRegister, Optimize: optimize}
+			vm := New(compileWithOptions(t, input, opts))
+			result := vm.RunWithOptions(bytes.NewBuffer([]byte{}), RunOptions{MaxInstructions: 10000})
+			if result.Reason != Halted {
+				t.Errorf("result.Reason wrong for %q with Optimize=%t. want=%s, got=%s",
+					input, optimize, Halted, result.Reason)
+			}
+			registers = append(registers, vm.Registers)
+		}
+
+		if fmt.Sprint(registers[0]) != fmt.Sprint(registers[1]) {
+			t.Errorf("registers differ for %q once optimized.\nwant=%v\ngot =%v",
+				input, registers[0], registers[1])
+		}
+	}
+}
+
+func TestFaultSource(t *testing.T) {
+	p := parser.New(lexer.NewFile("prog.sasm", "load $0 #1\n\ninc $1\ndiv $0 $2 $3"))
+	comp := compiler.New()
+	if err := comp.Compile(p.ParseProgram()); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fault := testFault(t, comp.Bytecode(), DivideByZero)
+	if fault == nil {
+		return
+	}
+	expected := "Divide by zero @ 12 (opcode 04), prog.sasm:4: div $0 $2 $3"
+	if fault.Error() != expected {
+		t.Errorf("wrong fault message.\nwant=%q\ngot =%q", expected, fault.Error())
+	}
+
+	vm := New(comp.Bytecode())
+	if source := vm.Source(8); source != "prog.sasm:3: add $1 $30 $1" {
+		t.Errorf("wrong source for an expanded instruction. got=%q", source)
+	}
+	if source := vm.Source(16); source != "" {
+		t.Errorf("expected no source past the end of the program. got=%q", source)
+	}
+
+	var out bytes.Buffer
+	vm = New(compile(t, "nop\nhlt"))
+	vm.Run(&out)
+	if out.String() != "HLT Encountered @ 4, line 2: hlt\n" {
+		t.Errorf("wrong HLT message. got=%q", out.String())
+	}
+}